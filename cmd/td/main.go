@@ -1,18 +1,22 @@
 package main
 
 import (
+	"cmp"
 	"fmt"
 	"os"
+	"path/filepath"
 	"runtime"
+	"time"
 
-	"github.com/mattn/go-colorable"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 
 	"github.com/tgagor/template-dockerfiles/pkg/builder"
 	"github.com/tgagor/template-dockerfiles/pkg/config"
+	"github.com/tgagor/template-dockerfiles/pkg/image"
 	"github.com/tgagor/template-dockerfiles/pkg/parser"
+	"github.com/tgagor/template-dockerfiles/pkg/progress"
 	"github.com/tgagor/template-dockerfiles/pkg/util"
 )
 
@@ -38,7 +42,7 @@ When 'docker build' is just not enough. :-)`,
 		return nil
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		initLogger(flags.Verbose)
+		util.FailOnError(initLogger())
 
 		// If version flag is provided, show the version and exit.
 		if flags.PrintVersion {
@@ -63,39 +67,31 @@ When 'docker build' is just not enough. :-)`,
 		if flags.Push {
 			log.Warn().Msg("Images will be pushed after building.")
 		}
+		if flags.Output != "" {
+			log.Info().Str("output", flags.Output).Msg("Images will be exported to")
+		}
 		if flags.Delete {
 			log.Warn().Msg("Templated Dockerfiles will be deleted at end.")
 		}
-		log.Info().Int("threads", flags.Threads).Msg("Number of")
-		if flags.Tag != "" {
-			log.Info().Str("tag", flags.Tag).Msg("Setting")
+		if flags.SkipUnchanged {
+			log.Info().Msg("Images with unchanged input hash will be skipped.")
 		}
-
-		// Parse configuration file
-		log.Info().Str("config", flags.BuildFile).Msg("Loading")
-		cfg, err := config.Load(flags.BuildFile)
-		util.FailOnError(err)
-		log.Trace().Str("config", fmt.Sprintf("%#v", cfg)).Msg("Loaded")
-
-		// Check if the image flag is valid
-		if flags.Image != "" {
-			if _, ok := cfg.Images[flags.Image]; !ok {
-				log.Error().Str("image", flags.Image).Msg("Image not found in configuration")
-				log.Error().Interface("available", cfg.ImageOrder).Msg("Try one of the following:")
-				os.Exit(1)
-			}
+		if flags.Resume {
+			log.Info().Msg("Images built by a previous run with unchanged inputs will be skipped.")
 		}
+		log.Info().Int("threads", flags.Threads).Msg("Number of")
 
-		// Run templating and image building
-		plan, err := parser.GeneratePlan(cfg, &flags)
-		if err != nil {
-			util.FailOnError(err, "Error during parsing/planning")
-		}
+		plan := generatePlan()
 
 		var engine builder.Builder
-		if flags.Engine == "buildx" {
+		switch flags.Engine {
+		case "buildx":
 			engine = &builder.BuildxBuilder{}
-		} else {
+		case "docker-api":
+			engine = &builder.APIBuilder{}
+		case "buildkit":
+			engine = &builder.BuildKitBuilder{}
+		default:
 			engine = &builder.DockerBuilder{}
 		}
 
@@ -105,6 +101,75 @@ When 'docker build' is just not enough. :-)`,
 	},
 }
 
+// generatePlan loads the configuration and renders all images into a build plan
+func generatePlan() *parser.Plan {
+	// images are validated against capabilities of the selected engine
+	flags.Engines = builder.Engines
+
+	if flags.Tag == "auto" {
+		tag, err := image.AutoTag(filepath.Dir(flags.BuildFile))
+		util.FailOnError(err, "Can't derive tag from git")
+		flags.Tag = tag
+	}
+	if flags.Tag != "" {
+		log.Info().Str("tag", flags.Tag).Msg("Setting")
+	}
+
+	// Parse configuration file
+	log.Info().Str("config", flags.BuildFile).Msg("Loading")
+	cfg, err := config.Load(flags.BuildFile)
+	util.FailOnError(err)
+	log.Trace().Str("config", fmt.Sprintf("%#v", cfg)).Msg("Loaded")
+
+	// Reproducible builds
+	if flags.SourceDateEpoch == "" {
+		flags.SourceDateEpoch = os.Getenv("SOURCE_DATE_EPOCH")
+	}
+	if flags.SourceDateEpoch != "" {
+		epoch, err := image.SourceDateEpoch(flags.SourceDateEpoch, filepath.Dir(flags.BuildFile))
+		util.FailOnError(err, "Can't resolve SOURCE_DATE_EPOCH")
+		flags.SourceDateEpoch = epoch
+		log.Info().Str("epoch", epoch).Msg("Reproducible builds with SOURCE_DATE_EPOCH")
+	}
+
+	// Check if the image flag is valid
+	if flags.Image != "" {
+		if _, ok := cfg.Images[flags.Image]; !ok {
+			log.Error().Str("image", flags.Image).Msg("Image not found in configuration")
+			log.Error().Interface("available", cfg.ImageOrder).Msg("Try one of the following:")
+			os.Exit(1)
+		}
+	}
+
+	// Run templating
+	plan, err := parser.GeneratePlan(cfg, &flags)
+	if err != nil {
+		util.FailOnError(err, "Error during parsing/planning")
+	}
+	return plan
+}
+
+var planCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "Print images, tags and dependencies, without building anything.",
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if flags.BuildFile == "" {
+			return fmt.Errorf("the --config flag is required")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		util.FailOnError(initLogger())
+
+		plan := generatePlan()
+		// plan renders Dockerfiles, they're not needed anymore
+		for _, node := range plan.Nodes {
+			node.Image.RemoveTemporaryDockerfile()
+		}
+		util.FailOnError(plan.Print(os.Stdout))
+	},
+}
+
 func init() {
 	if BuildVersion == "" {
 		BuildVersion = "development" // Fallback if not set during build
@@ -114,17 +179,34 @@ func init() {
 	// rootCmd.MarkPersistentFlagRequired("config")
 
 	cmd.Flags().BoolVarP(&flags.Build, "build", "b", false, "Build Docker images after templating")
-	cmd.Flags().StringVarP(&flags.Image, "image", "i", "", "Limit the build to a single image")
-	cmd.Flags().StringVarP(&flags.Engine, "engine", "e", "docker", "Select the container engine to use (docker, buiildx)")
+	cmd.PersistentFlags().StringVarP(&flags.Image, "image", "i", "", "Limit the build to a single image")
+	cmd.PersistentFlags().StringVarP(&flags.Engine, "engine", "e", "docker", "Select the container engine to use (docker, buildx, docker-api, buildkit)")
 	cmd.Flags().BoolVarP(&flags.Push, "push", "p", false, "Push Docker images after building")
+	cmd.Flags().IntVar(&flags.PushRetries, "push-retries", 3, "Retry failed registry requests when pushing, with exponential backoff")
+	cmd.Flags().StringVar(&flags.BuildkitAddr, "buildkit-addr", cmp.Or(os.Getenv("BUILDKIT_HOST"), builder.DefaultBuildkitAddr), "Address of buildkitd used by buildkit engine (defaults to BUILDKIT_HOST env)")
+	cmd.Flags().StringArrayVar(&flags.CacheFrom, "cache-from", nil, "Import build cache, like 'type=registry,ref=repo/cache' (buildx and buildkit engines)")
+	cmd.Flags().StringArrayVar(&flags.CacheTo, "cache-to", nil, "Export build cache, like 'type=registry,ref=repo/cache,mode=max' (buildx and buildkit engines)")
+	cmd.Flags().StringArrayVar(&flags.Secrets, "secret", nil, "Expose secret to builds, like 'id=token,src=token.txt' or 'id=token,env=TOKEN' (buildx and buildkit engines)")
+	cmd.PersistentFlags().BoolVar(&flags.SplitPlatforms, "split-platforms", false, "Build every platform of multi-platform images separately, then assemble image index (buildx and buildkit engines)")
+	cmd.Flags().StringVarP(&flags.Output, "output", "o", "", "Export images to 'oci:<dir>' (OCI layout) or 'tar:<dir>' (docker-archive), named after image and variables (buildx and buildkit engines)")
+	cmd.Flags().StringVar(&flags.Progress, "progress", progress.Auto, "Progress output: 'tty' shows status of running images, 'plain' prints their output prefixed with image name, 'auto' picks tty in terminal")
+	cmd.Flags().StringVar(&flags.LogDir, "log-dir", "", "Write complete output of commands run for every image to '<dir>/<image>.log', with timestamps")
 	cmd.Flags().BoolVarP(&flags.Delete, "delete", "d", false, "Delete templated Dockerfiles after successful building")
-	cmd.Flags().BoolVarP(&flags.Squash, "squash", "s", false, "Squash images to reduce size (experimental)")
+	cmd.Flags().BoolVarP(&flags.Squash, "squash", "s", false, "Squash layers of images into one, keeping their config and history")
+	cmd.Flags().BoolVar(&flags.Resume, "resume", false, "Skip images already built/pushed by a previous run with unchanged inputs")
+	cmd.PersistentFlags().StringVar(&flags.SourceDateEpoch, "source-date-epoch", "", "Unix timestamp, or 'git' for HEAD commit time, used for reproducible builds (defaults to SOURCE_DATE_EPOCH env)")
+	cmd.Flags().BoolVar(&flags.SkipUnchanged, "skip-unchanged", false, "Skip images, which already exist with the same input hash (locally, or in registry with --push)")
+	cmd.PersistentFlags().BoolVar(&flags.StrictDeps, "strict-deps", false, "Fail when FROM refers to registry/prefix, but no planned image produces it")
 	// cmd.Flags().BoolVarP(&flags.DryRun, "dry-run", "d", false, "Print actions but don't execute them")
 	cmd.Flags().IntVar(&flags.Threads, "parallel", runtime.NumCPU(), "Specify the number of threads to use, defaults to number of CPUs")
-	cmd.Flags().StringVarP(&flags.Tag, "tag", "t", "", "Tag to use as the image version")
-	cmd.Flags().BoolVar(&flags.NoColor, "no-color", false, "Disable color output")
-	cmd.Flags().BoolVarP(&flags.Verbose, "verbose", "v", false, "Increase verbosity of output")
+	cmd.PersistentFlags().StringVarP(&flags.Tag, "tag", "t", "", "Tag to use as the image version, or 'auto' to derive it from the nearest semver git tag")
+	cmd.PersistentFlags().BoolVar(&flags.NoColor, "no-color", false, "Disable color output")
+	cmd.PersistentFlags().BoolVarP(&flags.Verbose, "verbose", "v", false, "Increase verbosity of output, alias of --log-level debug")
+	cmd.PersistentFlags().StringVar(&flags.LogLevel, "log-level", "info", "Log level: trace, debug, info, warn or error")
+	cmd.PersistentFlags().StringVar(&flags.LogFormat, "log-format", config.LogConsole, "Log format: 'console' for humans, 'json' for one event per line")
 	cmd.Flags().BoolVarP(&flags.PrintVersion, "version", "V", false, "Display the application version and exit")
+
+	cmd.AddCommand(planCmd)
 }
 
 func main() {
@@ -133,52 +215,67 @@ func main() {
 	}
 }
 
-func initLogger(verbose bool) {
-	// Console writer
-	consoleWriter := zerolog.ConsoleWriter{
-		Out:     colorable.NewColorableStdout(),
-		NoColor: flags.NoColor,
+// initLogger sets up logging with --log-format and --log-level, where
+// --verbose is an alias of --log-level debug
+func initLogger() error {
+	level, err := logLevel(flags.LogLevel)
+	if err != nil {
+		return err
 	}
-	// Disable timestamps
-	zerolog.TimeFieldFormat = ""
-	consoleWriter.FormatTimestamp = func(i any) string {
-		return ""
+	if flags.Verbose && level > zerolog.DebugLevel {
+		level = zerolog.DebugLevel
 	}
+	flags.Debug = level <= zerolog.DebugLevel
+	// output of commands is shown in debug mode
+	flags.Verbose = flags.Debug
 
-	// Custom format for level
-	// consoleWriter.FormatLevel = func(i interface{}) string {
-	//     if ll, ok := i.(string); ok {
-	//         switch ll {
-	//         case "debug":
-	//             return "\033[01;36mDEBUG\033[0m" // Cyan
-	//         case "info":
-	//             return "\033[32mINFO\033[0m" // Green
-	//         case "warn":
-	//             return "\033[33mWARN\033[0m" // Yellow
-	//         case "error":
-	//             return "\033[31mERROR\033[0m" // Red
-	//         case "fatal":
-	//             return "\033[35mFATAL\033[0m" // Magenta
-	//         case "panic":
-	//             return "\033[31mPANIC\033[0m" // Red
-	//         default:
-	//             return ll
-	//         }
-	//     }
-	//     return ""
-	// }
-
-	// Base logger
-	baseLogger := zerolog.New(consoleWriter).With().Logger()
+	var baseLogger zerolog.Logger
+	switch flags.LogFormat {
+	case config.LogJSON:
+		zerolog.TimeFieldFormat = time.RFC3339Nano
+		// one event per line, it can't be mixed with status lines
+		baseLogger = zerolog.New(progress.Stdout).With().Timestamp().Logger()
+		if flags.Progress == progress.Auto {
+			flags.Progress = progress.Plain
+		}
+	case "", config.LogConsole:
+		// Console writer
+		consoleWriter := zerolog.ConsoleWriter{
+			// keeps status of running images at the bottom of the terminal
+			Out:     progress.Stdout,
+			NoColor: flags.NoColor,
+			// variables are already part of image name
+			FieldsExclude: []string{"combination"},
+		}
+		// Disable timestamps
+		zerolog.TimeFieldFormat = ""
+		consoleWriter.FormatTimestamp = func(i any) string {
+			return ""
+		}
+		baseLogger = zerolog.New(consoleWriter).With().Logger()
+	default:
+		return fmt.Errorf("unsupported --log-format '%s', use console or json", flags.LogFormat)
+	}
 
 	// Add caller only for debug level using a hook
-	if verbose {
-		log.Logger = baseLogger.Hook(zerolog.HookFunc(func(e *zerolog.Event, level zerolog.Level, msg string) {
+	if flags.Debug {
+		baseLogger = baseLogger.Hook(zerolog.HookFunc(func(e *zerolog.Event, level zerolog.Level, msg string) {
 			if level == zerolog.DebugLevel {
 				e.Caller()
 			}
-		})).Level(zerolog.DebugLevel)
-	} else {
-		log.Logger = baseLogger.Level(zerolog.InfoLevel)
+		}))
+	}
+	log.Logger = baseLogger.Level(level)
+	return nil
+}
+
+// logLevel parses --log-level
+func logLevel(name string) (zerolog.Level, error) {
+	switch name {
+	case "trace", "debug", "info", "warn", "error":
+		return zerolog.ParseLevel(name)
+	case "":
+		return zerolog.InfoLevel, nil
 	}
+	return zerolog.NoLevel, fmt.Errorf("unsupported --log-level '%s', use trace, debug, info, warn or error", name)
 }
@@ -0,0 +1,276 @@
+package builder
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/tgagor/template-dockerfiles/pkg/config"
+	"github.com/tgagor/template-dockerfiles/pkg/dockerapi"
+	"github.com/tgagor/template-dockerfiles/pkg/image"
+	"github.com/tgagor/template-dockerfiles/pkg/progress"
+	"github.com/tgagor/template-dockerfiles/pkg/squash"
+	"github.com/tgagor/template-dockerfiles/pkg/util"
+)
+
+// name of the Dockerfile added to the build context archive, as it doesn't
+// have to be inside of the build context
+const apiDockerfile = ".td-Dockerfile"
+
+// APIBuilder talks to the Docker Engine API directly, instead of running docker CLI
+type APIBuilder struct {
+	flags  *config.Flags
+	client *dockerapi.Client
+}
+
+func (b *APIBuilder) Init() error {
+	log.Info().Str("engine", "docker-api").Msg("Initializing")
+	if b.client != nil {
+		return nil
+	}
+	client, err := dockerapi.FromEnv()
+	if err != nil {
+		return err
+	}
+	b.client = client
+	return nil
+}
+
+// SetClient replaces client created by Init, e.g. to use a different daemon
+func (b *APIBuilder) SetClient(client *dockerapi.Client) {
+	b.client = client
+}
+
+func (b *APIBuilder) SetFlags(flags *config.Flags) {
+	b.flags = flags
+}
+
+func (b *APIBuilder) Process(ctx context.Context, img *image.Image) error {
+	if b.flags.Build {
+		if len(img.Options) > 0 {
+			log.Warn().Str("image", img.UniqName()).Strs("options", img.Options).Msg("Build options are not supported by docker-api engine. Skipping.")
+		}
+
+		progress.Step(ctx, "Building "+img.UniqName())
+		buildContext := contextArchive(img)
+		output, buf := b.progress(ctx)
+		_, err := b.client.Build(progress.WithPhase(ctx, "build"), dockerapi.BuildOptions{
+			Dockerfile: apiDockerfile,
+			Tags:       []string{img.UniqName()},
+			Labels:     img.Labels,
+			BuildArgs:  img.BuildArgs,
+		}, buildContext, output)
+		_ = buildContext.Close()
+		if err != nil {
+			b.logOutput(buf)
+			return fmt.Errorf("building %s failed: %w", img.UniqName(), err)
+		}
+		progress.Step(ctx, "Built "+img.UniqName())
+		// ensure cleanup of the transient image
+		defer b.remove(ctx, img.UniqName())
+	}
+
+	if b.flags.Build && b.flags.Squash {
+		if err := b.squash(progress.WithPhase(ctx, "squash"), img); err != nil {
+			return fmt.Errorf("squashing %s failed: %w", img.UniqName(), err)
+		}
+	}
+
+	if b.flags.Build {
+		for _, tag := range img.Tags() {
+			progress.Step(ctx, "Tagging "+tag)
+			if err := b.client.Tag(progress.WithPhase(ctx, "tag"), img.UniqName(), tag); err != nil {
+				return fmt.Errorf("tagging %s failed: %w", tag, err)
+			}
+		}
+	}
+
+	if b.flags.Push {
+		for _, tag := range img.Tags() {
+			progress.Step(ctx, "Pushing "+tag)
+			auth, err := dockerapi.LoadAuth(dockerapi.ConfigDir(), tag)
+			if err != nil {
+				return err
+			}
+			output, buf := b.progress(ctx)
+			if err := b.client.Push(progress.WithPhase(ctx, "push"), tag, auth, output); err != nil {
+				b.logOutput(buf)
+				return fmt.Errorf("pushing %s failed: %w", tag, err)
+			}
+		}
+	}
+
+	if b.flags.Delete {
+		img.RemoveTemporaryDockerfile()
+	}
+
+	return nil
+}
+
+// squash saves built image from the daemon, flattens its layers and loads it
+// back, keeping its whole config and history
+func (b *APIBuilder) squash(ctx context.Context, img *image.Image) error {
+	progress.Step(ctx, "Squashing "+img.UniqName())
+	before, err := b.client.Inspect(ctx, img.UniqName())
+	if err != nil {
+		return err
+	}
+
+	tmpDir, err := os.MkdirTemp("", "td-squash-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+	saved := filepath.Join(tmpDir, "saved.tar")
+	squashed := filepath.Join(tmpDir, "squashed.tar")
+
+	f, err := os.Create(saved)
+	if err != nil {
+		return err
+	}
+	err = b.client.Save(ctx, []string{img.UniqName()}, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := squash.Archive(saved, squashed, []string{img.UniqName()}); err != nil {
+		return err
+	}
+
+	f, err = os.Open(squashed)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	output, buf := b.progress(ctx)
+	if err := b.client.Load(ctx, f, output); err != nil {
+		b.logOutput(buf)
+		return err
+	}
+
+	after, err := b.client.Inspect(ctx, img.UniqName())
+	if err != nil {
+		return err
+	}
+	// remove interim image, unless it had a single layer and didn't change
+	if after.ID != before.ID {
+		b.remove(ctx, before.ID)
+	}
+	percentage := float64(after.Size)*100/float64(before.Size) - 100
+	progress.Logger(ctx).Info().Str("was", util.ByteCountIEC(uint64(before.Size))).Str("is", util.ByteCountIEC(uint64(after.Size))).Str("reduction", fmt.Sprintf("%.1f%%", percentage)).Msg("Squashed")
+	return nil
+}
+
+// remove deletes image from the daemon, failures are only logged as it's a cleanup
+func (b *APIBuilder) remove(ctx context.Context, name string) {
+	if err := b.client.Remove(ctx, name); err != nil {
+		var apiErr *dockerapi.APIError
+		if !errors.As(err, &apiErr) || !apiErr.NotFound() {
+			progress.Logger(ctx).Warn().Err(err).Str("name", name).Msg("Failed to remove image")
+		}
+	}
+}
+
+// localInputHash reads input hash label of a local image through the API,
+// missing image results in empty hash
+func (b *APIBuilder) localInputHash(ctx context.Context, ref string) (string, error) {
+	inspect, err := b.client.Inspect(ctx, ref)
+	var apiErr *dockerapi.APIError
+	if errors.As(err, &apiErr) && apiErr.NotFound() {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return inspect.Config.Labels[image.InputHashLabel], nil
+}
+
+// progress returns writer for streamed output: stdout in verbose mode,
+// otherwise the returned buffer, shown only on failure. With --log-dir, it's
+// written to the log file of the image as well.
+func (b *APIBuilder) progress(ctx context.Context) (io.Writer, *bytes.Buffer) {
+	buf := &bytes.Buffer{}
+	var output io.Writer = buf
+	if b.flags.Verbose {
+		output = progress.Output(ctx)
+	}
+	return progress.Tee(ctx, output), buf
+}
+
+func (b *APIBuilder) logOutput(buf *bytes.Buffer) {
+	if buf.Len() > 0 {
+		log.Error().Msg(strings.TrimRight(buf.String(), "\n"))
+	}
+}
+
+func (b *APIBuilder) Terminate() error {
+	return nil
+}
+
+// contextArchive streams tar archive of the build context, honoring ignore
+// files, with the Dockerfile added as apiDockerfile
+func contextArchive(img *image.Image) io.ReadCloser {
+	reader, writer := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(writer)
+		err := addFile(tw, apiDockerfile, img.Dockerfile)
+		if err == nil {
+			err = img.WalkContext(func(rel string, path string, d fs.DirEntry) error {
+				return addFile(tw, rel, path)
+			})
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+	return reader
+}
+
+func addFile(tw *tar.Writer, name string, path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	// ownership of the host doesn't matter for the build
+	header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	_, err = io.Copy(tw, f)
+	return err
+}
@@ -0,0 +1,230 @@
+package builder_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgagor/template-dockerfiles/pkg/builder"
+	"github.com/tgagor/template-dockerfiles/pkg/config"
+	"github.com/tgagor/template-dockerfiles/pkg/dockerapi"
+	"github.com/tgagor/template-dockerfiles/pkg/image"
+	"github.com/tgagor/template-dockerfiles/pkg/parser"
+)
+
+func TestAPIBuilder(t *testing.T) {
+	// no credentials for the fake registry
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+
+	contextDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "Dockerfile"), []byte("FROM alpine\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, ".dockerignore"), []byte("secret\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "secret"), []byte("password"), 0o644))
+	require.NoError(t, os.MkdirAll(filepath.Join(contextDir, "conf"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "conf", "app.conf"), []byte("key=value"), 0o644))
+
+	var mu sync.Mutex
+	var files, tagged, pushed, removed []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.URL.Path == "/build":
+			assert.Equal(t, ".td-Dockerfile", r.URL.Query().Get("dockerfile"))
+			assert.Equal(t, []string{"app"}, r.URL.Query()["t"])
+			tr := tar.NewReader(r.Body)
+			for {
+				header, err := tr.Next()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				require.NoError(t, err)
+				files = append(files, header.Name)
+			}
+			_, _ = io.WriteString(w, `{"aux":{"ID":"sha256:abc"}}`+"\n")
+		case r.URL.Path == "/images/app/tag":
+			tagged = append(tagged, r.URL.Query().Get("repo")+":"+r.URL.Query().Get("tag"))
+		case r.Method == http.MethodDelete:
+			removed = append(removed, strings.TrimPrefix(r.URL.Path, "/images/"))
+		case strings.HasSuffix(r.URL.Path, "/push"):
+			pushed = append(pushed, strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/images/"), "/push")+":"+r.URL.Query().Get("tag"))
+			_, _ = io.WriteString(w, `{"status":"Pushed"}`+"\n")
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+	}))
+	defer server.Close()
+
+	client, err := dockerapi.New("tcp://" + strings.TrimPrefix(server.URL, "http://"))
+	require.NoError(t, err)
+
+	cfg := &config.Config{
+		Registry: "repo.local",
+		Images: map[string]config.ImageConfig{
+			"app": {Dockerfile: "Dockerfile", Context: contextDir, Tags: []string{"app:1", "app:latest"}},
+		},
+	}
+	flags := &config.Flags{BuildFile: filepath.Join(contextDir, "build.yaml"), Build: true, Push: true, Engine: "docker-api"}
+	img := image.From("app", cfg, map[string]any{}, flags)
+	require.NoError(t, img.Validate())
+	require.NoError(t, img.Render())
+
+	engine := &builder.APIBuilder{}
+	engine.SetClient(client)
+	engine.SetFlags(flags)
+	require.NoError(t, engine.Init())
+	require.NoError(t, engine.Process(t.Context(), img))
+
+	assert.ElementsMatch(t, []string{".td-Dockerfile", ".dockerignore", "Dockerfile", "conf/", "conf/app.conf"}, files)
+	assert.Equal(t, []string{"repo.local/app:1", "repo.local/app:latest"}, tagged)
+	assert.Equal(t, []string{"repo.local/app:1", "repo.local/app:latest"}, pushed)
+	// transient image is removed, tags stay
+	assert.Equal(t, []string{"app"}, removed)
+}
+
+func TestAPIBuilderSquash(t *testing.T) {
+	contextDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "Dockerfile"), []byte("FROM alpine\n"), 0o644))
+
+	built, err := random.Image(256, 3)
+	require.NoError(t, err)
+	built, err = mutate.Config(built, v1.Config{User: "app", StopSignal: "SIGTERM"})
+	require.NoError(t, err)
+
+	var loaded []byte
+	var tagged, removed []string
+	id := "sha256:built"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "POST /build":
+			_, _ = io.WriteString(w, `{"aux":{"ID":"sha256:built"}}`+"\n")
+		case "GET /images/app/json":
+			size := 3000
+			if loaded != nil {
+				size = 1000
+			}
+			_, _ = fmt.Fprintf(w, `{"Id":%q,"Size":%d}`, id, size)
+		case "GET /images/get":
+			assert.Equal(t, []string{"app"}, r.URL.Query()["names"])
+			ref, err := name.NewTag("app")
+			require.NoError(t, err)
+			require.NoError(t, tarball.Write(ref, built, w))
+		case "POST /images/load":
+			body, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			loaded = body
+			id = "sha256:squashed"
+			_, _ = io.WriteString(w, `{"stream":"Loaded image: app:latest\n"}`+"\n")
+		case "POST /images/app/tag":
+			tagged = append(tagged, r.URL.Query().Get("repo")+":"+r.URL.Query().Get("tag"))
+		case "DELETE /images/sha256:built", "DELETE /images/app":
+			removed = append(removed, strings.TrimPrefix(r.URL.Path, "/images/"))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+	}))
+	defer server.Close()
+
+	client, err := dockerapi.New("tcp://" + strings.TrimPrefix(server.URL, "http://"))
+	require.NoError(t, err)
+
+	cfg := &config.Config{
+		Images: map[string]config.ImageConfig{
+			"app": {Dockerfile: "Dockerfile", Context: contextDir, Tags: []string{"app:1", "app:latest"}},
+		},
+	}
+	flags := &config.Flags{BuildFile: filepath.Join(contextDir, "build.yaml"), Build: true, Squash: true, Engine: "docker-api"}
+	img := image.From("app", cfg, map[string]any{}, flags)
+	require.NoError(t, img.Validate())
+	require.NoError(t, img.Render())
+
+	engine := &builder.APIBuilder{}
+	engine.SetClient(client)
+	engine.SetFlags(flags)
+	require.NoError(t, engine.Init())
+	require.NoError(t, engine.Process(t.Context(), img))
+
+	ref, err := name.NewTag("app")
+	require.NoError(t, err)
+	squashed, err := tarball.Image(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(loaded)), nil
+	}, &ref)
+	require.NoError(t, err)
+	layers, err := squashed.Layers()
+	require.NoError(t, err)
+	assert.Len(t, layers, 1)
+	squashedCfg, err := squashed.ConfigFile()
+	require.NoError(t, err)
+	assert.Equal(t, "app", squashedCfg.Config.User)
+	assert.Equal(t, "SIGTERM", squashedCfg.Config.StopSignal)
+
+	// squashed image is tagged, interim one removed with the transient name
+	assert.Equal(t, []string{"app:1", "app:latest"}, tagged)
+	assert.Equal(t, []string{"sha256:built", "app"}, removed)
+}
+
+func TestAPIBuilderSkipUnchanged(t *testing.T) {
+	contextDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "Dockerfile"), []byte("FROM alpine\n"), 0o644))
+
+	var mu sync.Mutex
+	existing := map[string]string{"app:1": "hash", "app:latest": "hash"}
+	builds := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/json"):
+			hash, ok := existing[strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/images/"), "/json")]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = io.WriteString(w, `{"message":"No such image"}`)
+				return
+			}
+			_, _ = fmt.Fprintf(w, `{"Id":"sha256:abc","Config":{"Labels":{%q:%q}}}`, image.InputHashLabel, hash)
+		case r.URL.Path == "/build":
+			builds++
+			_, _ = io.WriteString(w, `{"aux":{"ID":"sha256:abc"}}`+"\n")
+		}
+	}))
+	defer server.Close()
+
+	client, err := dockerapi.New("tcp://" + strings.TrimPrefix(server.URL, "http://"))
+	require.NoError(t, err)
+
+	cfg := &config.Config{
+		Images: map[string]config.ImageConfig{
+			"app": {Dockerfile: "Dockerfile", Context: contextDir, Tags: []string{"app:1", "app:latest"}},
+		},
+	}
+	flags := &config.Flags{BuildFile: filepath.Join(contextDir, "build.yaml"), Build: true, SkipUnchanged: true, Engine: "docker-api", Threads: 1}
+	img := image.From("app", cfg, map[string]any{}, flags)
+	require.NoError(t, img.Validate())
+	require.NoError(t, img.Render())
+	plan := &parser.Plan{Nodes: map[string]*parser.Node{"app": {ID: "app", Image: img, Hash: "hash"}}}
+
+	engine := &builder.APIBuilder{}
+	engine.SetClient(client)
+	require.NoError(t, builder.ExecutePlan(plan, engine, flags))
+	assert.Equal(t, 0, builds, "all tags exist with the same input hash")
+
+	delete(existing, "app:latest")
+	require.NoError(t, builder.ExecutePlan(plan, engine, flags))
+	assert.Equal(t, 1, builds, "missing tag is built")
+}
@@ -0,0 +1,75 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/tgagor/template-dockerfiles/pkg/config"
+	"github.com/tgagor/template-dockerfiles/pkg/image"
+	"github.com/tgagor/template-dockerfiles/pkg/progress"
+	"github.com/tgagor/template-dockerfiles/pkg/push"
+	"github.com/tgagor/template-dockerfiles/pkg/util"
+)
+
+// assembleIndex combines platforms built separately (--split-platforms) into
+// an image index. Index is pushed under all tags with --push, and saved as
+// OCI layout in --output directory, or next to the Dockerfile otherwise.
+// Layouts of platforms are removed once pushed, or with --delete.
+func assembleIndex(ctx context.Context, pusher *push.Pusher, img *image.Image, parts []*image.Image, flags *config.Flags) error {
+	if !flags.Build && !flags.Push {
+		return nil
+	}
+
+	images := make(map[string]v1.Image)
+	for _, part := range parts {
+		platform, err := v1.ParsePlatform(part.Platforms[0])
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(part.PlatformLayout()); err != nil {
+			return fmt.Errorf("no OCI layout of %s for %s in %s, use --build together with --push", img.UniqName(), part.Platforms[0], part.PlatformLayout())
+		}
+		if images[part.Platforms[0]], err = push.PlatformImage(part.PlatformLayout(), *platform); err != nil {
+			return err
+		}
+	}
+	progress.Step(ctx, "Assembling image index of "+img.UniqName()+" for "+strings.Join(img.Platforms, ", "))
+	index, err := push.Index(images, img.Platforms)
+	if err != nil {
+		return fmt.Errorf("assembling image index of %s failed: %w", img.UniqName(), err)
+	}
+
+	if flags.Push {
+		if err := pusher.Push(ctx, index, img.Tags()); err != nil {
+			return err
+		}
+	}
+	if flags.Build {
+		dir := ""
+		if output := img.Output(); output != nil {
+			dir = output.Path(img)
+		} else if !flags.Push {
+			dir = ociLayout(img)
+		}
+		if dir != "" {
+			progress.Step(ctx, "Saving "+img.UniqName()+" into "+dir)
+			if err := push.WriteLayout(dir, index, img.Tags()); err != nil {
+				return fmt.Errorf("saving %s into %s failed: %w", img.UniqName(), dir, err)
+			}
+		}
+	}
+
+	// platforms are kept only to assemble the index again, by --push without --build
+	if flags.Push || flags.Delete {
+		for _, part := range parts {
+			util.RemoveDir(part.PlatformLayout())
+		}
+	}
+	if flags.Delete {
+		img.RemoveTemporaryDockerfile()
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package builder_test
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgagor/template-dockerfiles/pkg/builder"
+	"github.com/tgagor/template-dockerfiles/pkg/config"
+	"github.com/tgagor/template-dockerfiles/pkg/image"
+	"github.com/tgagor/template-dockerfiles/pkg/parser"
+)
+
+// platformBuilder saves a random image for every part into its OCI layout
+type platformBuilder struct {
+	mu        sync.Mutex
+	platforms []string
+}
+
+func (b *platformBuilder) Init() error                  { return nil }
+func (b *platformBuilder) SetFlags(flags *config.Flags) {}
+func (b *platformBuilder) Terminate() error             { return nil }
+func (b *platformBuilder) Process(ctx context.Context, img *image.Image) error {
+	b.mu.Lock()
+	b.platforms = append(b.platforms, img.Platforms...)
+	b.mu.Unlock()
+
+	platform, err := v1.ParsePlatform(img.Platforms[0])
+	if err != nil {
+		return err
+	}
+	part, err := random.Image(512, 1)
+	if err != nil {
+		return err
+	}
+	cfg, err := part.ConfigFile()
+	if err != nil {
+		return err
+	}
+	cfg.OS, cfg.Architecture = platform.OS, platform.Architecture
+	if part, err = mutate.ConfigFile(part, cfg); err != nil {
+		return err
+	}
+	path, err := layout.Write(img.PlatformLayout(), empty.Index)
+	if err != nil {
+		return err
+	}
+	return path.AppendImage(part, layout.WithPlatform(*platform))
+}
+
+func TestExecutePlan_SplitPlatforms(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	t.Cleanup(server.Close)
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	dir := t.TempDir()
+	flags := &config.Flags{Threads: 2, Build: true, SplitPlatforms: true, BuildFile: filepath.Join(dir, "build.yaml")}
+	img := image.New()
+	img.Name = "app"
+	img.Registry = host
+	img.DockerfileTemplate = filepath.Join(dir, "Dockerfile")
+	img.Platforms = []string{"linux/amd64", "linux/arm64"}
+	img.SetOriginalTags([]string{"app:1.0", "app:latest"})
+	img.SetFlags(flags)
+
+	newPlan := func() *parser.Plan {
+		plan := &parser.Plan{Nodes: map[string]*parser.Node{}}
+		index := &parser.Node{ID: "app", Image: img}
+		for _, platform := range img.Platforms {
+			part := &parser.Node{ID: "app@" + platform, Image: img.ForPlatform(platform), DependsOn: []string{}, Platform: platform}
+			plan.Nodes[part.ID] = part
+			index.Parts = append(index.Parts, part.ID)
+		}
+		index.DependsOn = index.Parts
+		plan.Nodes[index.ID] = index
+		return plan
+	}
+
+	// without --push, index is saved next to the Dockerfile
+	b := &platformBuilder{}
+	require.NoError(t, builder.ExecutePlan(newPlan(), b, flags))
+	assert.ElementsMatch(t, img.Platforms, b.platforms)
+
+	path, err := layout.FromPath(filepath.Join(dir, "app.oci"))
+	require.NoError(t, err)
+	saved, err := path.ImageIndex()
+	require.NoError(t, err)
+	manifest, err := saved.IndexManifest()
+	require.NoError(t, err)
+	require.Len(t, manifest.Manifests, 2, "entry per tag")
+	assert.Equal(t, "1.0", manifest.Manifests[0].Annotations["org.opencontainers.image.ref.name"])
+	assembled, err := saved.ImageIndex(manifest.Manifests[0].Digest)
+	require.NoError(t, err)
+	assembledManifest, err := assembled.IndexManifest()
+	require.NoError(t, err)
+	require.Len(t, assembledManifest.Manifests, 2)
+	assert.Equal(t, "linux/arm64", assembledManifest.Manifests[1].Platform.String())
+
+	// platforms are kept for pushing later
+	for _, platform := range img.Platforms {
+		assert.DirExists(t, img.ForPlatform(platform).PlatformLayout())
+	}
+
+	// pushing without --build assembles parts from the previous run
+	flags.Build, flags.Push = false, true
+	b = &platformBuilder{}
+	require.NoError(t, builder.ExecutePlan(newPlan(), b, flags))
+	assert.Empty(t, b.platforms)
+	for _, tag := range img.Tags() {
+		ref, err := name.ParseReference(tag)
+		require.NoError(t, err)
+		desc, err := remote.Head(ref)
+		require.NoError(t, err, tag)
+		assert.Equal(t, manifest.Manifests[0].Digest, desc.Digest)
+	}
+
+	// and removes them once pushed
+	for _, platform := range img.Platforms {
+		assert.NoDirExists(t, img.ForPlatform(platform).PlatformLayout())
+	}
+}
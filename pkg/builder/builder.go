@@ -7,6 +7,15 @@ import (
 	"github.com/tgagor/template-dockerfiles/pkg/image"
 )
 
+// Engines lists capabilities of all engines, in order of preference, to
+// validate images before anything is built
+var Engines = []config.Engine{
+	{Name: "buildx", MultiPlatform: true, Cache: true, Secrets: true, Export: true, BuildKit: true},
+	{Name: "buildkit", MultiPlatform: true, Cache: true, Secrets: true, Export: true, BuildKit: true},
+	{Name: "docker", BuildKit: true},
+	{Name: "docker-api"}, // classic builder of the daemon
+}
+
 type Builder interface {
 	// initialize builder if needed
 	Init() error
@@ -18,3 +27,9 @@ type Builder interface {
 	// cleanup tasks
 	Terminate() error
 }
+
+// localImages is implemented by builders reading local images without
+// docker CLI, e.g. to check input hash on --skip-unchanged
+type localImages interface {
+	localInputHash(ctx context.Context, ref string) (string, error)
+}
@@ -0,0 +1,320 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/v2/core/content"
+	contentlocal "github.com/containerd/containerd/v2/plugins/content/local"
+	dockerconfig "github.com/docker/cli/cli/config"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/cmd/buildctl/build"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/session/auth/authprovider"
+	"github.com/moby/buildkit/util/progress/progressui"
+	"github.com/rs/zerolog/log"
+	"github.com/tgagor/template-dockerfiles/pkg/config"
+	"github.com/tgagor/template-dockerfiles/pkg/image"
+	"github.com/tgagor/template-dockerfiles/pkg/progress"
+	"github.com/tgagor/template-dockerfiles/pkg/push"
+	"github.com/tgagor/template-dockerfiles/pkg/util"
+	"github.com/tonistiigi/fsutil"
+	"golang.org/x/sync/errgroup"
+)
+
+// DefaultBuildkitAddr is used when neither --buildkit-addr nor BUILDKIT_HOST is set
+const DefaultBuildkitAddr = "unix:///run/buildkit/buildkitd.sock"
+
+// BuildKitBuilder talks to buildkitd directly, without Docker daemon. Images
+// are pushed straight to the registry, or exported as OCI layout.
+type BuildKitBuilder struct {
+	flags  *config.Flags
+	client *client.Client
+	pusher *push.Pusher
+
+	cacheImports []client.CacheOptionsEntry
+	cacheExports []client.CacheOptionsEntry
+	secrets      session.Attachable
+}
+
+func (b *BuildKitBuilder) Init() error {
+	addr := b.flags.BuildkitAddr
+	if addr == "" {
+		addr = DefaultBuildkitAddr
+	}
+	log.Info().Str("engine", "buildkit").Str("address", addr).Msg("Initializing")
+
+	b.pusher = push.New(b.flags.PushRetries)
+
+	var err error
+	if b.cacheImports, err = build.ParseImportCache(b.flags.CacheFrom); err != nil {
+		return fmt.Errorf("invalid --cache-from: %w", err)
+	}
+	if b.cacheExports, err = build.ParseExportCache(b.flags.CacheTo); err != nil {
+		return fmt.Errorf("invalid --cache-to: %w", err)
+	}
+	if len(b.flags.Secrets) > 0 {
+		if b.secrets, err = build.ParseSecret(b.flags.Secrets); err != nil {
+			return fmt.Errorf("invalid --secret: %w", err)
+		}
+	}
+
+	b.client, err = client.New(context.Background(), addr)
+	if err != nil {
+		return fmt.Errorf("can't connect to buildkitd at %s: %w", addr, err)
+	}
+	return nil
+}
+
+func (b *BuildKitBuilder) SetFlags(flags *config.Flags) {
+	b.flags = flags
+}
+
+func (b *BuildKitBuilder) Process(ctx context.Context, img *image.Image) error {
+	if !b.flags.Build && b.flags.Push {
+		// nothing to build, push OCI layout exported by a previous run
+		layout := ociLayout(img)
+		if output := img.Output(); output != nil {
+			if output.Format != image.OutputOCI {
+				return fmt.Errorf("buildkit engine can't push %s from %s, use --build together with --push", img.UniqName(), output.Path(img))
+			}
+			layout = output.Path(img)
+		}
+		if _, err := os.Stat(layout); err != nil {
+			return fmt.Errorf("no OCI layout of %s in %s, use --build together with --push", img.UniqName(), layout)
+		}
+		if err := b.pusher.PushLayout(progress.WithPhase(ctx, "push"), layout, img.Tags()); err != nil {
+			return err
+		}
+	}
+
+	if b.flags.Build {
+		if len(img.Options) > 0 {
+			log.Warn().Str("image", img.UniqName()).Strs("options", img.Options).Msg("Build options are not supported by buildkit engine. Skipping.")
+		}
+		opt, err := b.solveOpt(img)
+		if err != nil {
+			return err
+		}
+
+		tags := strings.Join(img.Tags(), ", ")
+		output := img.Output()
+		switch {
+		case img.Parent() != nil:
+			progress.Step(ctx, "Building "+img.UniqName()+" for "+img.Platforms[0]+" into "+img.PlatformLayout())
+		case b.flags.Squash:
+			progress.Step(ctx, "Building "+img.UniqName()+" into "+squashLayout(img)+" to squash it")
+		case b.flags.Push && output != nil:
+			progress.Step(ctx, "Building and pushing "+img.UniqName()+" into registry and "+output.Path(img)+" with tags: "+tags)
+		case b.flags.Push:
+			progress.Step(ctx, "Building and pushing "+img.UniqName()+" with tags: "+tags)
+		case output != nil:
+			progress.Step(ctx, "Building "+img.UniqName()+" into "+output.Path(img)+" with tags: "+tags)
+		default:
+			progress.Step(ctx, "Building "+img.UniqName()+" into "+ociLayout(img)+" with tags: "+tags)
+		}
+		if output != nil && img.Parent() == nil {
+			if err := os.MkdirAll(output.Dir, 0o755); err != nil {
+				return err
+			}
+		}
+		if err := b.solve(progress.WithPhase(ctx, "build"), img, opt); err != nil {
+			return err
+		}
+		progress.Step(ctx, "Built "+img.UniqName())
+		if b.flags.Squash {
+			if err := squashExported(progress.WithPhase(ctx, "squash"), b.pusher, img, b.flags, nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	if b.flags.Delete {
+		img.RemoveTemporaryDockerfile()
+	}
+
+	return nil
+}
+
+// solveOpt describes a build of the image with the Dockerfile frontend
+func (b *BuildKitBuilder) solveOpt(img *image.Image) (client.SolveOpt, error) {
+	contextFS, err := fsutil.NewFS(img.BuildContextDir)
+	if err != nil {
+		return client.SolveOpt{}, err
+	}
+	dockerfileFS, err := fsutil.NewFS(filepath.Dir(img.Dockerfile))
+	if err != nil {
+		return client.SolveOpt{}, err
+	}
+
+	attrs := map[string]string{
+		"filename": filepath.Base(img.Dockerfile),
+	}
+	if len(img.Platforms) > 0 {
+		attrs["platform"] = strings.Join(img.Platforms, ",")
+	}
+	for k, v := range img.BuildArgs {
+		attrs["build-arg:"+k] = v
+	}
+	for k, v := range img.Labels {
+		attrs["label:"+k] = v
+	}
+
+	// images of the plan, that aren't in the registry, are read from their layouts
+	contexts, err := baseContexts(img, b.layout)
+	if err != nil {
+		return client.SolveOpt{}, err
+	}
+	stores := make(map[string]content.Store)
+	for i, base := range contexts {
+		id := fmt.Sprintf("base-%d", i)
+		if stores[id], err = contentlocal.NewStore(base.dir); err != nil {
+			return client.SolveOpt{}, err
+		}
+		attrs["context:"+base.name] = "oci-layout://" + id + "@" + base.digest
+	}
+
+	attachables := []session.Attachable{
+		authprovider.NewDockerAuthProvider(authprovider.DockerAuthProviderConfig{
+			AuthConfigProvider: authprovider.LoadAuthConfig(dockerconfig.LoadDefaultConfigFile(os.Stderr)),
+		}),
+	}
+	if b.secrets != nil {
+		attachables = append(attachables, b.secrets)
+	}
+
+	return client.SolveOpt{
+		Frontend:      "dockerfile.v0",
+		FrontendAttrs: attrs,
+		LocalMounts: map[string]fsutil.FS{
+			"context":    contextFS,
+			"dockerfile": dockerfileFS,
+		},
+		OCIStores:    stores,
+		Exports:      b.exports(img),
+		CacheImports: b.cacheImports,
+		CacheExports: b.cacheExports,
+		Session:      attachables,
+	}, nil
+}
+
+// exports pushes image to the registry and exports it with --output. Without
+// any of them, or with docker-archive only, image is kept as OCI layout next
+// to the Dockerfile.
+func (b *BuildKitBuilder) exports(img *image.Image) []client.ExportEntry {
+	attrs := func() map[string]string {
+		// name annotates index.json with all tags
+		attrs := map[string]string{"name": strings.Join(img.Tags(), ",")}
+		if b.flags.SourceDateEpoch != "" {
+			attrs["rewrite-timestamp"] = "true"
+		}
+		return attrs
+	}
+
+	if img.Parent() != nil {
+		// single platform of the image, assembled into an image index later
+		export := client.ExportEntry{Type: client.ExporterOCI, Attrs: attrs(), OutputDir: img.PlatformLayout()}
+		export.Attrs["tar"] = "false"
+		return []client.ExportEntry{export}
+	}
+	if b.flags.Squash {
+		// pushed or exported after squashing
+		export := client.ExportEntry{Type: client.ExporterOCI, Attrs: attrs(), OutputDir: squashLayout(img)}
+		export.Attrs["tar"] = "false"
+		return []client.ExportEntry{export}
+	}
+
+	var exports []client.ExportEntry
+	if b.flags.Push {
+		export := client.ExportEntry{Type: client.ExporterImage, Attrs: attrs()}
+		export.Attrs["push"] = "true"
+		exports = append(exports, export)
+	}
+	output := img.Output()
+	switch {
+	case output != nil && output.Format == image.OutputTar:
+		path := output.Path(img)
+		exports = append(exports, client.ExportEntry{
+			Type:  client.ExporterDocker,
+			Attrs: attrs(),
+			Output: func(map[string]string) (io.WriteCloser, error) {
+				return os.Create(path)
+			},
+		})
+		if !b.flags.Push {
+			// dependent images are built from OCI layout
+			export := client.ExportEntry{Type: client.ExporterOCI, Attrs: attrs(), OutputDir: ociLayout(img)}
+			export.Attrs["tar"] = "false"
+			exports = append(exports, export)
+		}
+	case output != nil:
+		export := client.ExportEntry{Type: client.ExporterOCI, Attrs: attrs(), OutputDir: output.Path(img)}
+		export.Attrs["tar"] = "false"
+		exports = append(exports, export)
+	case !b.flags.Push:
+		export := client.ExportEntry{Type: client.ExporterOCI, Attrs: attrs(), OutputDir: ociLayout(img)}
+		export.Attrs["tar"] = "false"
+		exports = append(exports, export)
+	}
+	return exports
+}
+
+// solve runs the build, showing progress in verbose mode, or only when it fails
+func (b *BuildKitBuilder) solve(ctx context.Context, img *image.Image, opt client.SolveOpt) error {
+	output := progress.Output(ctx)
+	var buf bytes.Buffer
+	if !b.flags.Verbose {
+		output = &buf
+	}
+	display, err := progressui.NewDisplay(progress.Tee(ctx, output), progressui.PlainMode)
+	if err != nil {
+		return err
+	}
+
+	statusCh := make(chan *client.SolveStatus)
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		_, err := b.client.Solve(ctx, nil, opt, statusCh)
+		return err
+	})
+	eg.Go(func() error {
+		_, err := display.UpdateFrom(context.WithoutCancel(ctx), statusCh)
+		return err
+	})
+	if err := eg.Wait(); err != nil {
+		if buf.Len() > 0 {
+			log.Error().Msg(strings.TrimRight(buf.String(), "\n"))
+		}
+		return fmt.Errorf("building %s failed: %w", img.UniqName(), err)
+	}
+	return nil
+}
+
+// layout is a directory where image is kept as OCI layout, or "" when it's
+// only pushed
+func (b *BuildKitBuilder) layout(img *image.Image) string {
+	if output := img.Output(); output != nil && output.Format == image.OutputOCI {
+		return output.Path(img)
+	}
+	if b.flags.Push {
+		return ""
+	}
+	return ociLayout(img)
+}
+
+// ociLayout is a directory with OCI layout of the image, when it's not pushed
+func ociLayout(img *image.Image) string {
+	return filepath.Join(filepath.Dir(img.DockerfileTemplate), util.SanitizeForFileName(img.UniqName())+".oci")
+}
+
+func (b *BuildKitBuilder) Terminate() error {
+	if b.client != nil {
+		return b.client.Close()
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package builder_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tgagor/template-dockerfiles/pkg/builder"
+	"github.com/tgagor/template-dockerfiles/pkg/config"
+)
+
+func TestEngines(t *testing.T) {
+	t.Parallel()
+
+	engines := map[string]config.Engine{}
+	for _, engine := range builder.Engines {
+		engines[engine.Name] = engine
+	}
+	assert.True(t, engines["buildkit"].MultiPlatform)
+	assert.True(t, engines["buildx"].Secrets)
+	assert.False(t, engines["docker"].MultiPlatform)
+	assert.False(t, engines["docker-api"].Cache)
+}
+
+func TestBuildKitBuilderInvalidOptions(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		flags    config.Flags
+		expected string
+	}{
+		{"cache from", config.Flags{CacheFrom: []string{"type=registry,ref"}}, "invalid --cache-from"},
+		{"cache to", config.Flags{CacheTo: []string{"type=registry,ref"}}, "invalid --cache-to"},
+		{"secret", config.Flags{Secrets: []string{"src=token.txt"}}, "invalid --secret"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := &builder.BuildKitBuilder{}
+			engine.SetFlags(&tt.flags)
+			assert.ErrorContains(t, engine.Init(), tt.expected)
+		})
+	}
+}
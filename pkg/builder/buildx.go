@@ -2,20 +2,40 @@ package builder
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/rs/zerolog/log"
 	"github.com/tgagor/template-dockerfiles/pkg/cmd"
 	"github.com/tgagor/template-dockerfiles/pkg/config"
 	"github.com/tgagor/template-dockerfiles/pkg/image"
+	"github.com/tgagor/template-dockerfiles/pkg/progress"
+	"github.com/tgagor/template-dockerfiles/pkg/push"
+	"github.com/tgagor/template-dockerfiles/pkg/util"
 )
 
 type BuildxBuilder struct {
-	flags *config.Flags
+	flags  *config.Flags
+	pusher *push.Pusher
+	// containerd image store can load multi-platform images
+	containerdStore bool
 }
 
 func (b *BuildxBuilder) Init() error {
 	log.Info().Str("engine", "buildx").Msg("Initializing")
+	b.pusher = push.New(b.flags.PushRetries)
+
+	out, err := cmd.New("docker").Arg("info", "--format", "{{ json .DriverStatus }}").
+		SetQuiet(true).
+		Run(context.Background())
+	if err != nil {
+		log.Debug().Err(err).Msg("Can't detect image store, assuming multi-platform images can't be loaded")
+		return nil
+	}
+	b.containerdStore = strings.Contains(out, "io.containerd.snapshotter")
+	log.Debug().Bool("containerd", b.containerdStore).Msg("Detected image store")
 	return nil
 }
 
@@ -23,59 +43,80 @@ func (b *BuildxBuilder) SetFlags(flags *config.Flags) {
 	b.flags = flags
 }
 
+// Process builds image once with all tags. Depending on flags, result is
+// pushed, exported with --output, loaded into the local image store, or saved as OCI archive.
 func (b *BuildxBuilder) Process(ctx context.Context, img *image.Image) error {
 	if b.flags.Build {
+		if output := img.Output(); output != nil && img.Parent() == nil {
+			if err := os.MkdirAll(output.Dir, 0o755); err != nil {
+				return err
+			}
+		}
 		builder := cmd.New("docker").Arg("buildx").Arg("build")
 		if len(img.Platforms) > 0 {
 			builder.Arg(platformsToArgs(img.Platforms)...)
 		}
+		for _, cache := range b.flags.CacheFrom {
+			builder.Arg("--cache-from", cache)
+		}
+		for _, cache := range b.flags.CacheTo {
+			builder.Arg("--cache-to", cache)
+		}
+		for _, secret := range b.flags.Secrets {
+			builder.Arg("--secret", secret)
+		}
 		builder.Arg(img.Options...).
 			Arg("-f", img.Dockerfile).
-			Arg("-t", img.UniqName()).
 			Arg(labelsToArgs(img.Labels)...).
-			Arg(buildArgsToArgs(img.BuildArgs)...).
-			Arg("--load").
+			Arg(buildArgsToArgs(img.BuildArgs)...)
+		for _, imageTag := range img.Tags() {
+			builder.Arg("-t", imageTag)
+		}
+		contexts, err := baseContexts(img, b.layout)
+		if err != nil {
+			return err
+		}
+		for _, base := range contexts {
+			builder.Arg("--build-context", base.name+"=oci-layout://"+base.dir+"@"+base.digest)
+		}
+		builder.Arg(b.outputArgs(img)...).
 			Arg(img.BuildContextDir).
-			PreInfo("Building " + img.UniqName()).
+			PreInfo(b.describe(img)).
 			PostInfo("Built " + img.UniqName()).
 			SetVerbose(b.flags.Verbose)
-		if _, err := builder.Run(ctx); err != nil {
+		if _, err := builder.Run(progress.WithPhase(ctx, "build")); err != nil {
 			return err
 		}
-		defer b.Remove(ctx, img.UniqName())
-	}
-
-	if b.flags.Build && b.flags.Squash {
-		log.Warn().Msg("Squash is not supported for buildx engine. Skipping.")
-	}
-
-	if b.flags.Build || b.flags.Push {
-		tagger := cmd.New("docker").Arg("buildx").Arg("build")
-		if len(img.Platforms) > 0 {
-			tagger.Arg(platformsToArgs(img.Platforms)...)
-		}
-		tagger.Arg("-f", img.Dockerfile).
-			Arg(labelsToArgs(img.Labels)...).
-			Arg(buildArgsToArgs(img.BuildArgs)...).
-			Arg("--load")
-
-		// collect tagging commands to keep order
-		for _, imageTag := range img.Tags() {
-			tagger.Arg("-t", imageTag)
+		if output := img.Output(); output != nil && b.flags.Push && !b.flags.Squash {
+			// pushed from the export, so the build has a single exporter
+			if err := b.pushExported(progress.WithPhase(ctx, "push"), img, output); err != nil {
+				return err
+			}
 		}
-
-		if b.flags.Push {
-			tagger.Arg("--push")
-			tagger.PreInfo("Tagging and pushing " + img.UniqName() + " with tags: " + strings.Join(img.Tags(), ", "))
+		if output := img.Output(); output != nil && output.Format == image.OutputTar && !b.flags.Squash && !b.flags.Push && b.loadable(img) {
+			// dependent images are built from the local image store
+			if err := b.load(progress.WithPhase(ctx, "load"), output.Path(img)); err != nil {
+				return err
+			}
 		}
-
-		tagger.Arg(img.BuildContextDir).SetVerbose(b.flags.Verbose)
-
-		if !b.flags.Push {
-			tagger.PreInfo("Tagging " + img.UniqName() + " with tags: " + strings.Join(img.Tags(), ", "))
+		if b.flags.Squash {
+			var load func(context.Context, string) error
+			if b.loadable(img) {
+				load = b.load
+			}
+			if err := squashExported(progress.WithPhase(ctx, "squash"), b.pusher, img, b.flags, load); err != nil {
+				return err
+			}
 		}
-
-		if _, err := tagger.Run(ctx); err != nil {
+	} else if b.flags.Push {
+		// nothing to build, push what was exported or loaded by a previous run
+		if output := img.Output(); output != nil && output.Format == image.OutputOCI {
+			if err := b.pusher.PushLayout(progress.WithPhase(ctx, "push"), output.Path(img), img.Tags()); err != nil {
+				return err
+			}
+		} else if !b.loadable(img) {
+			return fmt.Errorf("multi-platform image %s can't be loaded into the local image store, use --build together with --push, or --output oci:<dir>", img.UniqName())
+		} else if err := pushFromDaemon(progress.WithPhase(ctx, "push"), b.pusher, img, b.flags.Verbose); err != nil {
 			return err
 		}
 	}
@@ -87,11 +128,104 @@ func (b *BuildxBuilder) Process(ctx context.Context, img *image.Image) error {
 	return nil
 }
 
-func (b *BuildxBuilder) Remove(ctx context.Context, imageName string) {
-	remover := cmd.New("docker").Arg("image", "rm", "-f").
-		Arg(imageName).
+// loadable tells if image can be loaded into the local image store, which
+// supports multi-platform images only with containerd
+func (b *BuildxBuilder) loadable(img *image.Image) bool {
+	return len(img.Platforms) <= 1 || b.containerdStore
+}
+
+// outputArgs selects where the single build goes: --output destination if
+// requested, then registry with --push, otherwise local image store whenever
+// possible, or an OCI archive. Build has always one exporter, as multiple ones
+// need BuildKit v0.13 or newer, exports are pushed after the build.
+// With SOURCE_DATE_EPOCH, timestamps of layer files are rewritten to make builds reproducible.
+func (b *BuildxBuilder) outputArgs(img *image.Image) []string {
+	options := ""
+	if b.flags.SourceDateEpoch != "" {
+		options = ",rewrite-timestamp=true"
+	}
+
+	if img.Parent() != nil {
+		// single platform of the image, assembled into an image index later
+		return []string{"--output", "type=oci,tar=false,dest=" + img.PlatformLayout() + options}
+	}
+	if b.flags.Squash {
+		// pushed, exported or loaded after squashing
+		return []string{"--output", "type=oci,tar=false,dest=" + squashLayout(img) + options}
+	}
+
+	output := img.Output()
+	switch {
+	case output != nil && output.Format == image.OutputOCI:
+		return []string{"--output", "type=oci,tar=false,dest=" + output.Path(img) + options}
+	case output != nil && output.Format == image.OutputTar:
+		return []string{"--output", "type=docker,dest=" + output.Path(img) + options}
+	case b.flags.Push:
+		return []string{"--output", "type=image,push=true" + options}
+	case b.loadable(img):
+		return []string{"--output", "type=docker" + options}
+	default:
+		return []string{"--output", "type=oci,dest=" + ociArchive(img) + options}
+	}
+}
+
+// pushExported pushes image exported with --output to the registry
+func (b *BuildxBuilder) pushExported(ctx context.Context, img *image.Image, output *image.Output) error {
+	if output.Format == image.OutputOCI {
+		return b.pusher.PushLayout(ctx, output.Path(img), img.Tags())
+	}
+	return pushArchive(ctx, b.pusher, output.Path(img), img.Tags())
+}
+
+func (b *BuildxBuilder) describe(img *image.Image) string {
+	tags := strings.Join(img.Tags(), ", ")
+	output := img.Output()
+	switch {
+	case img.Parent() != nil:
+		return "Building " + img.UniqName() + " for " + img.Platforms[0] + " into " + img.PlatformLayout()
+	case b.flags.Squash:
+		return "Building " + img.UniqName() + " into " + squashLayout(img) + " to squash it"
+	case b.flags.Push && output != nil:
+		return "Building and pushing " + img.UniqName() + " into registry and " + output.Path(img) + " with tags: " + tags
+	case b.flags.Push:
+		return "Building and pushing " + img.UniqName() + " with tags: " + tags
+	case output != nil:
+		return "Building " + img.UniqName() + " into " + output.Path(img) + " with tags: " + tags
+	case b.loadable(img):
+		return "Building " + img.UniqName() + " with tags: " + tags
+	default:
+		return "Building " + img.UniqName() + " into " + ociArchive(img) + " with tags: " + tags
+	}
+}
+
+// load imports docker-archive into the local image store
+func (b *BuildxBuilder) load(ctx context.Context, archive string) error {
+	loader := cmd.New("docker").Arg("load", "-i", archive).
 		SetVerbose(b.flags.Verbose)
-	_, _ = remover.Run(ctx)
+	_, err := loader.Run(ctx)
+	return err
+}
+
+// layout is a directory where image is kept as OCI layout, or "" when it's
+// pushed, loaded into the local image store or saved as an archive
+func (b *BuildxBuilder) layout(img *image.Image) string {
+	output := img.Output()
+	switch {
+	case output != nil && output.Format == image.OutputOCI:
+		return output.Path(img)
+	case b.flags.Push || output != nil:
+		return ""
+	case img.SplitPlatforms(), b.flags.Squash && len(img.Platforms) > 1:
+		// assembled or squashed image index is saved next to the Dockerfile
+		return ociLayout(img)
+	}
+	return ""
+}
+
+// ociArchive is a path of OCI archive with multi-platform image, that can't
+// be loaded into the local image store
+func ociArchive(img *image.Image) string {
+	return filepath.Join(filepath.Dir(img.DockerfileTemplate), util.SanitizeForFileName(img.UniqName())+".oci.tar")
 }
 
 func (b *BuildxBuilder) Terminate() error {
@@ -0,0 +1,228 @@
+package builder_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgagor/template-dockerfiles/pkg/builder"
+	"github.com/tgagor/template-dockerfiles/pkg/config"
+	"github.com/tgagor/template-dockerfiles/pkg/image"
+	"github.com/tgagor/template-dockerfiles/pkg/parser"
+)
+
+// fakeDocker puts docker on PATH, recording its calls, one per line
+func fakeDocker(t *testing.T, script string) func() []string {
+	bin := t.TempDir()
+	calls := filepath.Join(bin, "calls")
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "docker"), []byte("#!/bin/sh\necho \"$@\" >> "+calls+"\n"+script), 0o755))
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return func() []string {
+		data, err := os.ReadFile(calls)
+		require.NoError(t, err)
+		require.NoError(t, os.Remove(calls))
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+}
+
+func TestBuildxBuilderOutputs(t *testing.T) {
+	calls := fakeDocker(t, "")
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "Dockerfile"), []byte("FROM alpine\n"), 0o644))
+	newImage := func(flags *config.Flags, platforms ...string) *image.Image {
+		cfg := &config.Config{
+			Images: map[string]config.ImageConfig{
+				"app": {Dockerfile: "Dockerfile", Platforms: platforms, Tags: []string{"app:1", "app:latest"}},
+			},
+		}
+		flags.BuildFile = filepath.Join(dir, "build.yaml")
+		img := image.From("app", cfg, map[string]any{}, flags)
+		require.NoError(t, img.Render())
+		return img
+	}
+
+	tests := []struct {
+		name      string
+		flags     config.Flags
+		platforms []string
+		outputs   []string
+	}{
+		{
+			name:    "loaded into the local image store",
+			flags:   config.Flags{Build: true},
+			outputs: []string{"type=docker"},
+		},
+		{
+			name:    "pushed",
+			flags:   config.Flags{Build: true, Push: true},
+			outputs: []string{"type=image,push=true"},
+		},
+		{
+			name:      "multi-platform saved as OCI archive",
+			flags:     config.Flags{Build: true},
+			platforms: []string{"linux/amd64", "linux/arm64"},
+			outputs:   []string{"type=oci,dest=" + filepath.Join(dir, "app.oci.tar")},
+		},
+		{
+			name:      "multi-platform only pushed",
+			flags:     config.Flags{Build: true, Push: true},
+			platforms: []string{"linux/amd64", "linux/arm64"},
+			outputs:   []string{"type=image,push=true"},
+		},
+		{
+			name:    "reproducible",
+			flags:   config.Flags{Build: true, SourceDateEpoch: "1700000000"},
+			outputs: []string{"type=docker,rewrite-timestamp=true"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags := tt.flags
+			img := newImage(&flags, tt.platforms...)
+			engine := &builder.BuildxBuilder{}
+			engine.SetFlags(&flags)
+			require.NoError(t, engine.Init())
+			require.NoError(t, engine.Process(t.Context(), img))
+
+			lines := calls()
+			require.Len(t, lines, 2, "docker info and a single build")
+			build := strings.Fields(lines[1])
+			assert.Equal(t, []string{"buildx", "build"}, build[:2])
+			var outputs []string
+			for i, arg := range build {
+				if arg == "--output" {
+					outputs = append(outputs, build[i+1])
+				}
+			}
+			assert.Equal(t, tt.outputs, outputs)
+			assert.Contains(t, lines[1], "-t app:1 -t app:latest")
+		})
+	}
+
+	// multi-platform image can't be pushed from the local image store
+	flags := config.Flags{Push: true}
+	engine := &builder.BuildxBuilder{}
+	engine.SetFlags(&flags)
+	require.NoError(t, engine.Init())
+	err := engine.Process(t.Context(), newImage(&flags, "linux/amd64", "linux/arm64"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "can't be loaded into the local image store")
+}
+
+func TestBuildxBuilderBaseImages(t *testing.T) {
+	// fake docker exports an OCI layout
+	src := t.TempDir()
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	require.NoError(t, os.WriteFile(filepath.Join(src, "index.json"), []byte(`{"schemaVersion":2,"manifests":[{"mediaType":"application/vnd.oci.image.index.v1+json","digest":"`+digest+`","size":1}]}`), 0o644))
+	calls := fakeDocker(t, `for arg; do
+  case "$arg" in
+    type=oci,tar=false,dest=*) cp -r `+src+` "${arg#type=oci,tar=false,dest=}" ;;
+  esac
+done
+`)
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "base.Dockerfile"), []byte("FROM alpine\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "app.Dockerfile"), []byte("FROM repo.local/base:1\n"), 0o644))
+	cfg := &config.Config{
+		Registry:   "repo.local",
+		ImageOrder: []string{"base", "app"},
+		Images: map[string]config.ImageConfig{
+			"base": {Dockerfile: "base.Dockerfile", Tags: []string{"base:1"}},
+			"app":  {Dockerfile: "app.Dockerfile", Tags: []string{"app:1"}},
+		},
+	}
+	dist := filepath.Join(dir, "dist")
+	build := func(output string) []string {
+		flags := &config.Flags{BuildFile: filepath.Join(dir, "build.yaml"), Build: true, Engine: "buildx", Engines: builder.Engines, Output: output, Threads: 1}
+		plan, err := parser.GeneratePlan(cfg, flags)
+		require.NoError(t, err)
+		require.Equal(t, []string{"base"}, plan.Nodes["app"].DependsOn)
+		require.NoError(t, builder.ExecutePlan(plan, &builder.BuildxBuilder{}, flags))
+		return calls()
+	}
+
+	// exported base image is passed to the dependent build as named context
+	lines := build("oci:" + dist)
+	assert.NotContains(t, buildOf(t, lines, "repo.local/base:1"), "--build-context")
+	assert.Contains(t, buildOf(t, lines, "repo.local/app:1"), "--build-context repo.local/base:1=oci-layout://"+filepath.Join(dist, "base")+"@"+digest)
+
+	// docker-archive is loaded as well, dependent build finds it in the image store
+	lines = build("tar:" + dist)
+	assert.Contains(t, lines, "load -i "+filepath.Join(dist, "base.tar"))
+	assert.NotContains(t, buildOf(t, lines, "repo.local/app:1"), "--build-context")
+}
+
+func TestBuildxBuilderInputHashStable(t *testing.T) {
+	// fake docker exports OCI archives into the template directory
+	calls := fakeDocker(t, `for arg; do
+  case "$arg" in
+    type=oci,dest=*) echo archive > "${arg#type=oci,dest=}" ;;
+  esac
+done
+`)
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "Dockerfile.tpl"), []byte("FROM alpine:{{ .alpine }}\nCOPY . /app\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "app.conf"), []byte("port=8080\n"), 0o644))
+	cfg := &config.Config{
+		ImageOrder: []string{"app"},
+		Images: map[string]config.ImageConfig{
+			"app": {
+				Dockerfile: "Dockerfile.tpl",
+				Variables:  map[string]any{"alpine": []any{"3.20", "3.21"}},
+				Platforms:  []string{"linux/amd64", "linux/arm64"},
+				Tags:       []string{"app:{{ .alpine }}"},
+			},
+		},
+	}
+	flags := &config.Flags{BuildFile: filepath.Join(dir, "build.yaml"), Build: true, Resume: true, Engine: "buildx", Engines: builder.Engines, Threads: 1}
+	hashes := func() map[string]string {
+		plan, err := parser.GeneratePlan(cfg, flags)
+		require.NoError(t, err)
+		hashes := map[string]string{}
+		for id, node := range plan.Nodes {
+			require.NotEmpty(t, node.Hash, id)
+			hashes[id] = node.Hash
+		}
+		return hashes
+	}
+
+	build := func() {
+		plan, err := parser.GeneratePlan(cfg, flags)
+		require.NoError(t, err)
+		require.NoError(t, builder.ExecutePlan(plan, &builder.BuildxBuilder{}, flags))
+		calls()
+	}
+
+	initial := hashes()
+	build()
+	require.FileExists(t, filepath.Join(dir, "app-alpine-3.20.oci.tar"))
+	assert.Equal(t, initial, hashes(), "outputs of td don't change inputs")
+	build()
+	assert.Equal(t, initial, hashes(), "outputs of td don't change inputs")
+
+	// layouts of split platforms and squashed images are left behind too
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "app-alpine-3.20-linux_amd64.oci"), 0o755))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "app-alpine-3.20.squash.oci"), 0o755))
+	assert.Equal(t, initial, hashes(), "outputs of td don't change inputs")
+
+	// while any other change in the build context does
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "app.conf"), []byte("port=8081\n"), 0o644))
+	assert.NotEqual(t, initial, hashes())
+}
+
+// buildOf finds the build of image tagged with tag in calls of fake docker
+func buildOf(t *testing.T, calls []string, tag string) string {
+	for _, call := range calls {
+		if strings.HasPrefix(call, "buildx build") && strings.Contains(call, "-t "+tag+" ") {
+			return call
+		}
+	}
+	t.Fatalf("%s wasn't built: %v", tag, calls)
+	return ""
+}
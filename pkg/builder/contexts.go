@@ -0,0 +1,70 @@
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/distribution/reference"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/tgagor/template-dockerfiles/pkg/image"
+)
+
+// baseContext is an image of the plan kept as OCI layout, passed to builds of
+// dependent images as a named context, as they can't pull it from anywhere
+type baseContext struct {
+	name   string // reference from FROM, as the Dockerfile frontend looks it up
+	dir    string
+	digest string
+}
+
+// baseContexts lists OCI layouts of images the img is built on. layout returns
+// directory where the engine keeps a base image, or "" when it's pushed or
+// loaded into the local image store. Bases without layout, like the ones
+// skipped with --skip-unchanged, are resolved as before.
+func baseContexts(img *image.Image, layout func(*image.Image) string) ([]baseContext, error) {
+	var contexts []baseContext
+	for _, ref := range slices.Sorted(maps.Keys(img.Bases())) {
+		dir := layout(img.Bases()[ref])
+		if dir == "" {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, "index.json")); err != nil {
+			continue
+		}
+		digest, err := layoutDigest(dir)
+		if err != nil {
+			return nil, fmt.Errorf("can't use %s as %s for %s: %w", dir, ref, img.UniqName(), err)
+		}
+		if dir, err = filepath.Abs(dir); err != nil {
+			return nil, err
+		}
+		name := ref
+		if named, err := reference.ParseNormalizedNamed(ref); err == nil {
+			name = strings.TrimSuffix(reference.FamiliarString(named), ":latest")
+		}
+		contexts = append(contexts, baseContext{name: name, dir: dir, digest: digest})
+	}
+	return contexts, nil
+}
+
+// layoutDigest returns digest of the most recent image or index in OCI
+// layout. BuildKit adds an entry per tag and appends new builds at the end.
+func layoutDigest(dir string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return "", err
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return "", fmt.Errorf("can't read OCI layout %s: %w", dir, err)
+	}
+	if len(index.Manifests) == 0 {
+		return "", fmt.Errorf("no images in OCI layout %s", dir)
+	}
+	return index.Manifests[len(index.Manifests)-1].Digest.String(), nil
+}
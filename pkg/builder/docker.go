@@ -2,23 +2,28 @@ package builder
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"strings"
+	"os"
+	"path/filepath"
 
 	"github.com/rs/zerolog/log"
 	"github.com/tgagor/template-dockerfiles/pkg/cmd"
 	"github.com/tgagor/template-dockerfiles/pkg/config"
 	"github.com/tgagor/template-dockerfiles/pkg/image"
+	"github.com/tgagor/template-dockerfiles/pkg/progress"
+	"github.com/tgagor/template-dockerfiles/pkg/push"
+	"github.com/tgagor/template-dockerfiles/pkg/squash"
 	"github.com/tgagor/template-dockerfiles/pkg/util"
 )
 
 type DockerBuilder struct {
-	flags *config.Flags
+	flags  *config.Flags
+	pusher *push.Pusher
 }
 
 func (b *DockerBuilder) Init() error {
 	log.Info().Str("engine", "docker").Msg("Initializing")
+	b.pusher = push.New(b.flags.PushRetries)
 	return nil
 }
 
@@ -38,7 +43,7 @@ func (b *DockerBuilder) Process(ctx context.Context, img *image.Image) error {
 			PreInfo("Building " + img.UniqName()).
 			PostInfo("Built " + img.UniqName()).
 			SetVerbose(b.flags.Verbose)
-		if _, err := builder.Run(ctx); err != nil {
+		if _, err := builder.Run(progress.WithPhase(ctx, "build")); err != nil {
 			return err
 		}
 		// ensure cleanup of the transient image
@@ -46,7 +51,7 @@ func (b *DockerBuilder) Process(ctx context.Context, img *image.Image) error {
 	}
 
 	if b.flags.Build && b.flags.Squash {
-		if err := b.Squash(ctx, img); err != nil {
+		if err := b.Squash(progress.WithPhase(ctx, "squash"), img); err != nil {
 			return err
 		}
 	}
@@ -58,23 +63,15 @@ func (b *DockerBuilder) Process(ctx context.Context, img *image.Image) error {
 				Arg(tag).
 				PreInfo("Tagging " + tag).
 				SetVerbose(b.flags.Verbose)
-			if _, err := tagger.Run(ctx); err != nil {
+			if _, err := tagger.Run(progress.WithPhase(ctx, "tag")); err != nil {
 				return err
 			}
 		}
 	}
 
 	if b.flags.Push {
-		for _, tag := range img.Tags() {
-			pusher := cmd.New("docker").Arg("push").
-				Arg(tag).
-				PreInfo("Pushing " + tag)
-			if !b.flags.Verbose {
-				pusher.Arg("--quiet")
-			}
-			if _, err := pusher.Run(ctx); err != nil {
-				return err
-			}
+		if err := pushFromDaemon(progress.WithPhase(ctx, "push"), b.pusher, img, b.flags.Verbose); err != nil {
+			return err
 		}
 	}
 
@@ -85,18 +82,9 @@ func (b *DockerBuilder) Process(ctx context.Context, img *image.Image) error {
 	return nil
 }
 
+// Squash flattens layers of the built image: it's saved from the local image
+// store, squashed and loaded back, keeping its whole config and history
 func (b *DockerBuilder) Squash(ctx context.Context, img *image.Image) error {
-	containerName := "run-" + util.SanitizeForFileName(img.UniqName())
-
-	runItFirst := cmd.New("docker").Arg("run").
-		Arg("--name", containerName).
-		Arg(img.UniqName()).
-		Arg("true").
-		SetVerbose(b.flags.Verbose)
-	if _, err := runItFirst.Run(ctx); err != nil {
-		return err
-	}
-
 	imgMetadata, err := InspectImage(img.UniqName())
 	if err != nil {
 		return fmt.Errorf("couldn't inspect Docker image %s: %w", img.UniqName(), err)
@@ -104,77 +92,45 @@ func (b *DockerBuilder) Squash(ctx context.Context, img *image.Image) error {
 	log.Trace().Interface("data", imgMetadata).Msg("Docker inspect result")
 	sizeBefore := imgMetadata[0].Size
 
-	tmpTarFile := containerName + ".tar"
-	exportIt := cmd.New("docker").Arg("export").
-		Arg(containerName).
-		Arg("-o", tmpTarFile).
-		PreInfo(fmt.Sprintf("Squashing %s", img.UniqName())).
-		SetVerbose(b.flags.Verbose)
-	if _, err := exportIt.Run(ctx); err != nil {
+	tmpDir, err := os.MkdirTemp("", "td-squash-")
+	if err != nil {
 		return err
 	}
-	defer util.RemoveFile(tmpTarFile)
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+	saved := filepath.Join(tmpDir, "saved.tar")
+	squashed := filepath.Join(tmpDir, "squashed.tar")
 
-	cleanupCmd := cmd.New("docker").Arg("rm").Arg("-f").Arg(containerName)
-	if _, err := cleanupCmd.Run(ctx); err != nil {
+	saveIt := cmd.New("docker").Arg("save").
+		Arg("-o", saved).
+		Arg(img.UniqName()).
+		PreInfo(fmt.Sprintf("Squashing %s", img.UniqName())).
+		SetVerbose(b.flags.Verbose)
+	if _, err := saveIt.Run(ctx); err != nil {
 		return err
 	}
-
-	importIt := cmd.New("docker").Arg("import")
-	for _, item := range imgMetadata {
-		// paring ENV
-		for _, env := range item.Config.Env {
-			importIt.Arg("--change", "ENV "+env)
-		}
-
-		// parsing CMD
-		if command, err := json.Marshal(item.Config.Cmd); err != nil {
-			log.Error().Err(err).Str("image", img.UniqName()).Msg("Can't parse CMD")
-		} else {
-			importIt.Arg("--change", "CMD "+string(command))
-		}
-
-		// parsing VOLUME
-		if vol, err := json.Marshal(item.Config.Volumes); err != nil {
-			log.Error().Err(err).Str("image", img.UniqName()).Msg("Can't parse VOLUME")
-		} else {
-			importIt.Arg("--change", "VOLUME "+string(vol))
-		}
-
-		// parsing LABELS
-		for key, value := range item.Config.Labels {
-			importIt.Arg("--change", fmt.Sprintf("LABEL %s=\"%s\"", key, strings.ReplaceAll(value, "\n", "")))
-		}
-
-		// parsing ENTRYPOINT
-		if entrypoint, err := json.Marshal(item.Config.Entrypoint); err != nil {
-			log.Error().Err(err).Str("image", img.UniqName()).Msg("Can't parse ENTRYPOINT")
-		} else {
-			importIt.Arg("--change", "CMD "+string(entrypoint))
-		}
-
-		// parsing WORKDIR
-		if item.Config.WorkingDir != "" {
-			importIt.Arg("--change", "WORKDIR "+item.Config.WorkingDir)
-		}
+	if err := squash.Archive(saved, squashed, []string{img.UniqName()}); err != nil {
+		return fmt.Errorf("squashing %s failed: %w", img.UniqName(), err)
 	}
-	importIt.Arg(tmpTarFile).Arg(img.UniqName()).SetVerbose(b.flags.Verbose)
-	if _, err := importIt.Run(ctx); err != nil {
+	loadIt := cmd.New("docker").Arg("load", "-i", squashed).
+		SetVerbose(b.flags.Verbose)
+	if _, err := loadIt.Run(ctx); err != nil {
 		return err
 	}
 
-	// remove interim images
-	oldImgHash := strings.TrimPrefix(imgMetadata[0].Id, "sha256:")[:12]
-	b.Remove(ctx, oldImgHash)
-
-	// Log reduction
 	imgMetadataAfter, err := InspectImage(img.UniqName())
-	if err == nil {
-		sizeAfter := imgMetadataAfter[0].Size
-		percentage := float64(sizeAfter)*100/float64(sizeBefore) - 100
-		log.Info().Str("image", img.UniqName()).Str("was", util.ByteCountIEC(sizeBefore)).Str("is", util.ByteCountIEC(sizeAfter)).Str("reduction", fmt.Sprintf("%.1f%%", percentage)).Msg("Squashed")
+	if err != nil {
+		return nil
+	}
+	// remove interim image, unless it had a single layer and didn't change
+	if imgMetadataAfter[0].Id != imgMetadata[0].Id {
+		b.Remove(ctx, imgMetadata[0].Id)
 	}
 
+	// Log reduction
+	sizeAfter := imgMetadataAfter[0].Size
+	percentage := float64(sizeAfter)*100/float64(sizeBefore) - 100
+	log.Info().Str("image", img.UniqName()).Str("was", util.ByteCountIEC(sizeBefore)).Str("is", util.ByteCountIEC(sizeAfter)).Str("reduction", fmt.Sprintf("%.1f%%", percentage)).Msg("Squashed")
+
 	return nil
 }
 
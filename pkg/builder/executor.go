@@ -6,22 +6,52 @@ import (
 
 	"github.com/rs/zerolog/log"
 	"github.com/tgagor/template-dockerfiles/pkg/config"
+	"github.com/tgagor/template-dockerfiles/pkg/image"
 	"github.com/tgagor/template-dockerfiles/pkg/parser"
+	"github.com/tgagor/template-dockerfiles/pkg/progress"
+	"github.com/tgagor/template-dockerfiles/pkg/push"
+	"github.com/tgagor/template-dockerfiles/pkg/state"
 )
 
 // ExecutePlan orchestrates the build process across all nodes of the dependency graph,
 // processing ready images non-blocking through a worker pool.
 func ExecutePlan(plan *parser.Plan, b Builder, flags *config.Flags) error {
+	// flags are needed to initialize some engines, like address of buildkitd
+	b.SetFlags(flags)
 	if err := b.Init(); err != nil {
 		return err
 	}
-	b.SetFlags(flags)
 	defer func() {
 		if err := b.Terminate(); err != nil {
 			log.Warn().Err(err).Msg("Builder termination failed")
 		}
 	}()
 
+	// progress is recorded, so failed runs can be resumed
+	var st *state.State
+	if flags.Build || flags.Push {
+		var err error
+		if st, err = state.Load(state.Path(flags.BuildFile, flags.Tag)); err != nil {
+			return err
+		}
+	}
+
+	// image indexes of platforms built separately are assembled and pushed by td itself
+	pusher := push.New(flags.PushRetries)
+
+	display, err := progress.New(progress.Stdout, flags.Progress, len(plan.Nodes))
+	if err != nil {
+		return err
+	}
+	if flags.LogDir != "" {
+		if err := display.SetLogDir(flags.LogDir); err != nil {
+			return err
+		}
+	}
+	if flags.LogFormat == config.LogJSON {
+		display.SetStructured()
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -57,6 +87,8 @@ func ExecutePlan(plan *parser.Plan, b Builder, flags *config.Flags) error {
 	}
 
 	log.Info().Int("total_images", len(plan.Nodes)).Int("workers", workerCount).Msg("Starting parallel DAG execution")
+	display.Start()
+	defer display.Stop()
 
 	var wg sync.WaitGroup
 	errCh := make(chan error, workerCount)
@@ -75,10 +107,19 @@ func ExecutePlan(plan *parser.Plan, b Builder, flags *config.Flags) error {
 					}
 
 					node := plan.Nodes[id]
-					log.Info().Str("image", node.Image.Name).Msg("Processing")
-
-					if err := b.Process(ctx, node.Image); err != nil {
-						log.Error().Err(err).Str("image", node.Image.Name).Msg("Processing failed")
+					// every event logged for the node tells which image and combination it's about
+					logger := log.With().Str("image", id).Interface("combination", node.Image.Variables).Logger()
+					nodeCtx, err := display.Begin(logger.WithContext(ctx), id)
+					if err == nil {
+						err = processNode(nodeCtx, plan, node, b, pusher, st, flags)
+						display.End(nodeCtx, err)
+					}
+					if err != nil {
+						failure := logger.Error().Err(err)
+						if path := display.LogPath(id); path != "" {
+							failure.Str("log", path)
+						}
+						failure.Msg("Processing failed")
 						errCh <- err
 						cancel() // cancel context for other workers
 						return
@@ -116,3 +157,68 @@ func ExecutePlan(plan *parser.Plan, b Builder, flags *config.Flags) error {
 
 	return nil
 }
+
+// processNode runs the builder for a single node and records the outcome.
+// Node is skipped on --resume if it was already done with the same inputs,
+// or on --skip-unchanged if its image with the same input hash already exists.
+// Nodes with parts built for single platforms assemble them into an image index.
+func processNode(ctx context.Context, plan *parser.Plan, node *parser.Node, b Builder, pusher *push.Pusher, st *state.State, flags *config.Flags) error {
+	var err error
+	switch {
+	case flags.Resume && st != nil && st.Done(node.ID, node.Hash, flags.Push):
+		progress.Logger(ctx).Info().Msg("Skipping, already done with unchanged inputs")
+		progress.Skip(ctx)
+		removeTemporaryFiles(node, flags)
+		return nil
+	case flags.SkipUnchanged && isUnchanged(ctx, b, node.Image, node.Hash, flags.Push):
+		progress.Logger(ctx).Info().Str("hash", node.Hash).Msg("Skipping, image with the same inputs already exists")
+		progress.Skip(ctx)
+		removeTemporaryFiles(node, flags)
+	case len(node.Parts) > 0:
+		var parts []*image.Image
+		for _, id := range node.Parts {
+			parts = append(parts, plan.Nodes[id].Image)
+		}
+		err = assembleIndex(progress.WithPhase(ctx, "assemble"), pusher, node.Image, parts, flags)
+	case node.Platform != "" && !flags.Build:
+		// nothing to build, part from a previous run is pushed with the whole index
+		progress.Skip(ctx)
+	default:
+		progress.Step(ctx, "Processing "+node.ID)
+		err = process(ctx, b, node.Image, flags)
+	}
+
+	if st != nil && ctx.Err() == nil {
+		outcome := state.Built
+		switch {
+		case err != nil:
+			outcome = state.Failed
+		case flags.Push:
+			outcome = state.Pushed
+		}
+		if recordErr := st.Record(node.ID, node.Hash, outcome); recordErr != nil {
+			progress.Logger(ctx).Warn().Err(recordErr).Msg("Failed to record build state")
+		}
+	}
+
+	return err
+}
+
+// process builds image from a staged copy of the build context, which is
+// removed as soon as the builder is done with it
+func process(ctx context.Context, b Builder, img *image.Image, flags *config.Flags) error {
+	if flags.Build {
+		if err := img.StageContext(); err != nil {
+			return err
+		}
+		defer img.RemoveStagingContext()
+	}
+	return b.Process(ctx, img)
+}
+
+// removeTemporaryFiles cleans up after skipped nodes, the way builders do after processing
+func removeTemporaryFiles(node *parser.Node, flags *config.Flags) {
+	if flags.Delete {
+		node.Image.RemoveTemporaryDockerfile()
+	}
+}
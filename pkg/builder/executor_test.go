@@ -2,6 +2,11 @@ package builder_test
 
 import (
 	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -9,6 +14,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/tgagor/template-dockerfiles/pkg/builder"
+	"github.com/tgagor/template-dockerfiles/pkg/cmd"
 	"github.com/tgagor/template-dockerfiles/pkg/config"
 	"github.com/tgagor/template-dockerfiles/pkg/image"
 	"github.com/tgagor/template-dockerfiles/pkg/parser"
@@ -18,6 +24,7 @@ type mockBuilder struct {
 	mu            sync.Mutex
 	processCalls  []string
 	processDelays map[string]time.Duration
+	processErrors map[string]error
 	startTimes    map[string]time.Time
 	endTimes      map[string]time.Time
 }
@@ -25,6 +32,7 @@ type mockBuilder struct {
 func newMockBuilder() *mockBuilder {
 	return &mockBuilder{
 		processDelays: make(map[string]time.Duration),
+		processErrors: make(map[string]error),
 		startTimes:    make(map[string]time.Time),
 		endTimes:      make(map[string]time.Time),
 	}
@@ -38,8 +46,13 @@ func (m *mockBuilder) Process(ctx context.Context, img *image.Image) error {
 	m.startTimes[img.Name] = time.Now()
 	m.processCalls = append(m.processCalls, img.Name)
 	delay := m.processDelays[img.Name]
+	err := m.processErrors[img.Name]
 	m.mu.Unlock()
 
+	if err != nil {
+		return err
+	}
+
 	select {
 	case <-time.After(delay):
 	case <-ctx.Done():
@@ -99,3 +112,106 @@ func TestExecutePlan_DAGConcurrency(t *testing.T) {
 	// E should have started concurrently with A
 	assert.True(t, mock.startTimes["E"].Before(mock.endTimes["A"]))
 }
+
+func TestExecutePlan_Resume(t *testing.T) {
+	// A -> B -> C
+	newPlan := func(hashOfB string) *parser.Plan {
+		return &parser.Plan{
+			Nodes: map[string]*parser.Node{
+				"A": {ID: "A", Image: &image.Image{Name: "A"}, DependsOn: []string{}, Hash: "a"},
+				"B": {ID: "B", Image: &image.Image{Name: "B"}, DependsOn: []string{"A"}, Hash: hashOfB},
+				"C": {ID: "C", Image: &image.Image{Name: "C"}, DependsOn: []string{"B"}, Hash: "c-" + hashOfB},
+			},
+		}
+	}
+	flags := &config.Flags{Threads: 2, Build: true, BuildFile: filepath.Join(t.TempDir(), "build.yaml")}
+
+	// first run fails on B
+	failing := newMockBuilder()
+	failing.processErrors["B"] = errors.New("boom")
+	require.Error(t, builder.ExecutePlan(newPlan("b"), failing, flags))
+	assert.Equal(t, []string{"A", "B"}, failing.processCalls)
+
+	// resumed run skips A, which was already built
+	flags.Resume = true
+	resumed := newMockBuilder()
+	require.NoError(t, builder.ExecutePlan(newPlan("b"), resumed, flags))
+	assert.Equal(t, []string{"B", "C"}, resumed.processCalls)
+
+	// nothing to do when all inputs are unchanged
+	noop := newMockBuilder()
+	require.NoError(t, builder.ExecutePlan(newPlan("b"), noop, flags))
+	assert.Empty(t, noop.processCalls)
+
+	// changed node and everything downstream gets rebuilt
+	changed := newMockBuilder()
+	require.NoError(t, builder.ExecutePlan(newPlan("b2"), changed, flags))
+	assert.Equal(t, []string{"B", "C"}, changed.processCalls)
+
+	// pushing requires nodes to be pushed before, not only built
+	flags.Push = true
+	pushed := newMockBuilder()
+	require.NoError(t, builder.ExecutePlan(newPlan("b2"), pushed, flags))
+	assert.Equal(t, []string{"A", "B", "C"}, pushed.processCalls)
+}
+
+// commandBuilder runs a shell script for every image, like engines run docker
+type commandBuilder struct {
+	scripts map[string]string
+}
+
+func (c *commandBuilder) Init() error                  { return nil }
+func (c *commandBuilder) SetFlags(flags *config.Flags) {}
+func (c *commandBuilder) Terminate() error             { return nil }
+func (c *commandBuilder) Process(ctx context.Context, img *image.Image) error {
+	_, err := cmd.New("sh").Arg("-c", c.scripts[img.Name]).
+		PreInfo("Building " + img.Name).
+		SetQuiet(true).
+		Run(ctx)
+	return err
+}
+
+func TestExecutePlan_LogDir(t *testing.T) {
+	plan := &parser.Plan{
+		Nodes: map[string]*parser.Node{
+			"app-alpine": {ID: "app-alpine", Image: &image.Image{Name: "app-alpine"}, DependsOn: []string{}},
+			// fails last, once the other images are done
+			"app-debian":             {ID: "app-debian", Image: &image.Image{Name: "app-debian"}, DependsOn: []string{"app-debian@linux/arm64"}},
+			"app-debian@linux/arm64": {ID: "app-debian@linux/arm64", Image: &image.Image{Name: "app-debian-arm64"}, DependsOn: []string{"app-alpine"}},
+		},
+	}
+	engine := &commandBuilder{scripts: map[string]string{
+		"app-alpine":       "echo step 1; echo warning >&2",
+		"app-debian":       "echo step 1; echo broken >&2; exit 3",
+		"app-debian-arm64": "echo arm64",
+	}}
+	dir := filepath.Join(t.TempDir(), "logs")
+	flags := &config.Flags{Threads: 1, LogDir: dir}
+
+	err := builder.ExecutePlan(plan, engine, flags)
+	require.Error(t, err)
+
+	failed, err := os.ReadFile(filepath.Join(dir, "app-debian.log"))
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(failed), "\n"), "\n")
+	// every line has a timestamp, like 2024-01-02T03:04:05.000Z
+	for _, line := range lines {
+		assert.Regexp(t, `^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{3}\S* `, line)
+	}
+	content := regexp.MustCompile(`(?m)^\S+ `).ReplaceAllString(string(failed), "")
+	assert.Contains(t, content, "Building app-debian\n$ sh -c echo step 1; echo broken >&2; exit 3\nstep 1\nbroken\n")
+	assert.Regexp(t, `Failed after \d+\.\ds: exit status 3\n$`, content)
+
+	// platforms get their own file, with a name safe for file systems
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	assert.ElementsMatch(t, []string{"app-alpine.log", "app-debian.log", "app-debian_linux_arm64.log"}, names)
+	part, err := os.ReadFile(filepath.Join(dir, "app-debian_linux_arm64.log"))
+	require.NoError(t, err)
+	assert.Contains(t, string(part), " arm64\n")
+	assert.NotContains(t, string(part), "broken")
+}
@@ -0,0 +1,49 @@
+package builder
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/tgagor/template-dockerfiles/pkg/cmd"
+	"github.com/tgagor/template-dockerfiles/pkg/image"
+	"github.com/tgagor/template-dockerfiles/pkg/push"
+)
+
+// pushFromDaemon saves image from the local image store with 'docker save'
+// and pushes it like images exported by other engines: once per repository,
+// with retries, remaining tags are created from the pushed manifest
+func pushFromDaemon(ctx context.Context, pusher *push.Pusher, img *image.Image, verbose bool) error {
+	tmpDir, err := os.MkdirTemp("", "td-push-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	archive := filepath.Join(tmpDir, "saved.tar")
+	saver := cmd.New("docker").Arg("save").
+		Arg("-o", archive).
+		Arg(img.Tags()[0]).
+		PreInfo("Saving " + img.Tags()[0] + " from the local image store").
+		SetVerbose(verbose)
+	if _, err := saver.Run(ctx); err != nil {
+		return err
+	}
+	return pushArchive(ctx, pusher, archive, img.Tags())
+}
+
+// pushArchive pushes docker-archive, or OCI layout archived by containerd
+// image store, under all tags
+func pushArchive(ctx context.Context, pusher *push.Pusher, archive string, tags []string) error {
+	tmpDir, err := os.MkdirTemp("", "td-archive-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	artifact, err := push.FromArchive(archive, tmpDir)
+	if err != nil {
+		return err
+	}
+	return pusher.Push(ctx, artifact, tags)
+}
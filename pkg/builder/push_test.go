@@ -0,0 +1,132 @@
+package builder_test
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgagor/template-dockerfiles/pkg/builder"
+	"github.com/tgagor/template-dockerfiles/pkg/config"
+	"github.com/tgagor/template-dockerfiles/pkg/image"
+	"github.com/tgagor/template-dockerfiles/pkg/push"
+)
+
+func TestDockerBuilderPush(t *testing.T) {
+	// registry fails the first manifest upload
+	var mu sync.Mutex
+	failed := false
+	handler := registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fail := !failed && r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/manifests/")
+		failed = failed || fail
+		mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	// fake docker saves a random image from the local image store
+	saved, err := random.Image(256, 2)
+	require.NoError(t, err)
+	src := filepath.Join(t.TempDir(), "saved.tar")
+	require.NoError(t, push.WriteArchive(src, saved, []string{host + "/app:1"}))
+	bin := t.TempDir()
+	script := `#!/bin/sh
+[ "$1" = "save" ] && [ "$4" = "` + host + `/app:1" ] && cp ` + src + ` "$3"
+`
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "docker"), []byte(script), 0o755))
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+
+	flags := &config.Flags{Push: true, Engine: "docker", PushRetries: 1}
+	img := image.New()
+	img.Name = "app"
+	img.Registry = host
+	img.SetOriginalTags([]string{"app:1", "app:latest"})
+	img.SetFlags(flags)
+
+	engine := &builder.DockerBuilder{}
+	engine.SetFlags(flags)
+	require.NoError(t, engine.Init())
+	require.NoError(t, engine.Process(t.Context(), img))
+
+	assert.True(t, failed)
+	want, err := saved.Digest()
+	require.NoError(t, err)
+	for _, tag := range img.Tags() {
+		ref, err := name.ParseReference(tag)
+		require.NoError(t, err)
+		desc, err := remote.Head(ref)
+		require.NoError(t, err, tag)
+		assert.Equal(t, want, desc.Digest, tag)
+	}
+}
+
+func TestBuildxBuilderPushExported(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	t.Cleanup(server.Close)
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	// fake docker exports a random image as OCI layout or docker-archive
+	built, err := random.Image(256, 2)
+	require.NoError(t, err)
+	src := t.TempDir()
+	require.NoError(t, push.WriteLayout(filepath.Join(src, "layout"), built, []string{host + "/app:1"}))
+	require.NoError(t, push.WriteArchive(filepath.Join(src, "archive.tar"), built, []string{host + "/app:1"}))
+	calls := fakeDocker(t, `for arg; do
+  case "$arg" in
+    type=oci,tar=false,dest=*) cp -r `+filepath.Join(src, "layout")+` "${arg#type=oci,tar=false,dest=}" ;;
+    type=docker,dest=*) cp `+filepath.Join(src, "archive.tar")+` "${arg#type=docker,dest=}" ;;
+  esac
+done
+`)
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+
+	want, err := built.Digest()
+	require.NoError(t, err)
+	for _, format := range []string{"oci", "tar"} {
+		t.Run(format, func(t *testing.T) {
+			dir := t.TempDir()
+			flags := &config.Flags{Build: true, Push: true, Output: format + ":" + filepath.Join(dir, "dist"), PushRetries: 1}
+			img := image.New()
+			img.Name = "app-" + format
+			img.Registry = host
+			img.SetOriginalTags([]string{"app-" + format + ":1", "app-" + format + ":latest"})
+			img.SetFlags(flags)
+
+			engine := &builder.BuildxBuilder{}
+			engine.SetFlags(flags)
+			require.NoError(t, engine.Init())
+			require.NoError(t, engine.Process(t.Context(), img))
+
+			// a single exporter, pushed after the build
+			lines := calls()
+			require.Len(t, lines, 2)
+			assert.NotContains(t, lines[1], "push=true")
+			for _, tag := range img.Tags() {
+				ref, err := name.ParseReference(tag)
+				require.NoError(t, err)
+				desc, err := remote.Head(ref)
+				require.NoError(t, err, tag)
+				assert.Equal(t, want, desc.Digest, tag)
+			}
+		})
+	}
+}
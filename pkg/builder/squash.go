@@ -0,0 +1,110 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/tgagor/template-dockerfiles/pkg/config"
+	"github.com/tgagor/template-dockerfiles/pkg/image"
+	"github.com/tgagor/template-dockerfiles/pkg/progress"
+	"github.com/tgagor/template-dockerfiles/pkg/push"
+	"github.com/tgagor/template-dockerfiles/pkg/squash"
+	"github.com/tgagor/template-dockerfiles/pkg/util"
+)
+
+// squashLayout is a directory where engines exporting OCI layouts put the
+// image to squash. Platforms built separately are squashed in place.
+func squashLayout(img *image.Image) string {
+	if img.Parent() != nil {
+		return img.PlatformLayout()
+	}
+	return filepath.Join(filepath.Dir(img.DockerfileTemplate), util.SanitizeForFileName(img.UniqName())+".squash.oci")
+}
+
+// squashExported squashes image exported into squashLayout and sends it where
+// the build would: registry with --push, --output destination, local image
+// store with load, or OCI layout next to the Dockerfile. Engines without
+// image store pass nil load. Unless pushed, docker-archive is also loaded, or
+// saved as OCI layout, for dependent images.
+func squashExported(ctx context.Context, pusher *push.Pusher, img *image.Image, flags *config.Flags, load func(ctx context.Context, archive string) error) error {
+	dir := squashLayout(img)
+	artifact, err := push.FromLayout(dir)
+	if err != nil {
+		return err
+	}
+	progress.Step(ctx, "Squashing "+img.UniqName())
+	squashed, err := squash.Artifact(artifact)
+	if err != nil {
+		return fmt.Errorf("squashing %s failed: %w", img.UniqName(), err)
+	}
+
+	if img.Parent() != nil {
+		// assembled into an image index later
+		return push.WriteLayout(dir, squashed, img.Tags())
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	sent := false
+	if flags.Push {
+		if err := pusher.Push(ctx, squashed, img.Tags()); err != nil {
+			return err
+		}
+		sent = true
+	}
+
+	single, isSingle := singleImage(squashed)
+	switch output := img.Output(); {
+	case output != nil && output.Format == image.OutputTar:
+		if !isSingle {
+			return fmt.Errorf("multi-platform image %s can't be exported as docker-archive", img.UniqName())
+		}
+		progress.Step(ctx, "Saving "+img.UniqName()+" into "+output.Path(img))
+		if err := push.WriteArchive(output.Path(img), single, img.Tags()); err != nil {
+			return err
+		}
+		switch {
+		case sent:
+			return nil
+		case load != nil:
+			// dependent images are built from the local image store
+			return load(ctx, output.Path(img))
+		}
+		// or from OCI layout, when there's no image store
+		return push.WriteLayout(ociLayout(img), squashed, img.Tags())
+	case output != nil:
+		progress.Step(ctx, "Saving "+img.UniqName()+" into "+output.Path(img))
+		return push.WriteLayout(output.Path(img), squashed, img.Tags())
+	case sent:
+		return nil
+	case load != nil && isSingle:
+		archive := dir + ".tar"
+		if err := push.WriteArchive(archive, single, img.Tags()); err != nil {
+			return err
+		}
+		defer util.RemoveFile(archive)
+		return load(ctx, archive)
+	}
+
+	progress.Step(ctx, "Saving "+img.UniqName()+" into "+ociLayout(img))
+	return push.WriteLayout(ociLayout(img), squashed, img.Tags())
+}
+
+// singleImage returns the image, or the only image of an index
+func singleImage(artifact remote.Taggable) (v1.Image, bool) {
+	switch artifact := artifact.(type) {
+	case v1.Image:
+		return artifact, true
+	case v1.ImageIndex:
+		manifest, err := artifact.IndexManifest()
+		if err != nil || len(manifest.Manifests) != 1 {
+			return nil, false
+		}
+		img, err := artifact.Image(manifest.Manifests[0].Digest)
+		return img, err == nil
+	}
+	return nil, false
+}
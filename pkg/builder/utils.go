@@ -1,12 +1,15 @@
 package builder
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"strings"
 
 	"github.com/rs/zerolog/log"
 	"github.com/tgagor/template-dockerfiles/pkg/cmd"
+	"github.com/tgagor/template-dockerfiles/pkg/image"
+	"github.com/tgagor/template-dockerfiles/pkg/progress"
 )
 
 type DockerInspect []struct {
@@ -62,3 +65,82 @@ func platformsToArgs(platforms []string) []string {
 	args = append(args, "--platform", strings.Join(platforms, ","))
 	return args
 }
+
+// imageLabels describes labels part of image config, as returned by
+// docker buildx imagetools inspect --format '{{ json .Image }}'
+type imageLabels struct {
+	Config struct {
+		Labels map[string]string `json:"Labels"`
+	} `json:"config"`
+}
+
+// existingInputHash reads input hash label of an image from the local image store,
+// or from the registry when remote is set. Missing image results in empty hash.
+func existingInputHash(ctx context.Context, ref string, remote bool) string {
+	if !remote {
+		out, err := cmd.New("docker").Arg("image", "inspect").
+			Arg("--format", fmt.Sprintf("{{ index .Config.Labels %q }}", image.InputHashLabel)).
+			Arg(ref).
+			SetQuiet(true).
+			Run(ctx)
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(out)
+	}
+
+	out, err := cmd.New("docker").Arg("buildx", "imagetools", "inspect").
+		Arg("--format", "{{ json .Image }}").
+		Arg(ref).
+		SetQuiet(true).
+		Run(ctx)
+	if err != nil {
+		return ""
+	}
+
+	// single platform image
+	var single imageLabels
+	if err := json.Unmarshal([]byte(out), &single); err == nil && single.Config.Labels != nil {
+		return single.Config.Labels[image.InputHashLabel]
+	}
+	// multi-platform images are returned per platform, all have to match
+	var multi map[string]imageLabels
+	if err := json.Unmarshal([]byte(out), &multi); err != nil {
+		return ""
+	}
+	hash := ""
+	for _, platform := range multi {
+		label := platform.Config.Labels[image.InputHashLabel]
+		if label == "" || (hash != "" && hash != label) {
+			return ""
+		}
+		hash = label
+	}
+	return hash
+}
+
+// isUnchanged checks if all tags of the image already exist with the same input hash.
+// Local images are read by the builder if it can.
+func isUnchanged(ctx context.Context, b Builder, img *image.Image, hash string, remote bool) bool {
+	if hash == "" {
+		return false
+	}
+	local, canRead := b.(localImages)
+	for _, tag := range img.Tags() {
+		existing := ""
+		if canRead && !remote {
+			var err error
+			if existing, err = local.localInputHash(ctx, tag); err != nil {
+				progress.Logger(ctx).Warn().Err(err).Str("tag", tag).Msg("Failed to inspect image, assuming it changed")
+				return false
+			}
+		} else {
+			existing = existingInputHash(ctx, tag, remote)
+		}
+		if existing != hash {
+			log.Debug().Str("tag", tag).Bool("remote", remote).Msg("Changed or missing")
+			return false
+		}
+	}
+	return true
+}
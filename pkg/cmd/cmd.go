@@ -8,14 +8,17 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"time"
 
 	"github.com/rs/zerolog/log"
+	"github.com/tgagor/template-dockerfiles/pkg/progress"
 )
 
 type Cmd struct {
 	cmd      string
 	args     []string
 	verbose  bool
+	quiet    bool
 	preText  string
 	postText string
 	output   string
@@ -44,6 +47,12 @@ func (c *Cmd) SetVerbose(verbosity bool) *Cmd {
 	return c
 }
 
+// SetQuiet disables error logging, for commands expected to fail, like probes
+func (c *Cmd) SetQuiet(quiet bool) *Cmd {
+	c.quiet = quiet
+	return c
+}
+
 func (c *Cmd) PreInfo(msg string) *Cmd {
 	c.preText = msg
 	return c
@@ -59,7 +68,7 @@ func (c *Cmd) Run(ctx context.Context) (string, error) {
 		return "", errors.New("command not set")
 	}
 	if c.preText != "" {
-		log.Info().Msg(c.preText)
+		progress.Step(ctx, c.preText)
 	}
 
 	cmd := exec.CommandContext(ctx, c.cmd, c.args...)
@@ -67,39 +76,51 @@ func (c *Cmd) Run(ctx context.Context) (string, error) {
 	// pipe the commands output to the applications
 	var b bytes.Buffer
 	if c.verbose {
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+		// prefixed with image name, when run for one
+		cmd.Stdout = progress.Output(ctx)
 	} else {
 		cmd.Stdout = &b
-		cmd.Stderr = &b
 	}
-
-	log.Debug().Str("cmd", c.cmd).Interface("args", c.args).Msg("Running")
+	// complete output goes to the log file of image with --log-dir
+	progress.Log(ctx, "$ "+c.String())
+	cmd.Stdout = progress.Tee(ctx, cmd.Stdout)
+	cmd.Stderr = cmd.Stdout
+
+	// events carry image and phase of the context
+	logger := progress.Logger(ctx).With().Str("command", c.String()).Logger()
+	logger.Debug().Msg("Running")
+	started := time.Now()
 	err := cmd.Run()
+	duration := time.Since(started)
 
 	// Check for context cancellation or timeout
 	if ctx.Err() != nil {
 		// If the context was canceled, suppress output and return context error
 		if ctx.Err() == context.Canceled {
-			log.Warn().Str("cmd", c.cmd).Msg("Command was cancelled")
+			logger.Warn().Dur("duration", duration).Msg("Command was cancelled")
 		} else if ctx.Err() == context.DeadlineExceeded {
-			log.Warn().Str("cmd", c.cmd).Msg("Command timed out")
+			logger.Warn().Dur("duration", duration).Msg("Command timed out")
 		}
 		return "", ctx.Err()
 	}
 
 	// Handle other errors
 	if err != nil {
-		log.Error().Err(err).Str("cmd", c.cmd).Interface("args", c.args).Msg("Could not run command")
 		// c.setOutput(&b)
 		c.output = b.String()
-		log.Error().Msg(c.output)
+		if !c.quiet {
+			logger.Error().Err(err).Dur("duration", duration).Msg("Could not run command")
+			if c.output != "" {
+				logger.Error().Str("stream", "output").Msg(c.output)
+			}
+		}
 		return c.output, err
 	}
 	c.output = b.String()
+	logger.Debug().Dur("duration", duration).Msg("Command finished")
 
 	if c.postText != "" {
-		log.Info().Msg(c.postText)
+		progress.Step(ctx, c.postText)
 	}
 	return c.output, nil
 }
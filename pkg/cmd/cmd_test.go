@@ -1,10 +1,17 @@
 package cmd_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
 	"testing"
 
+	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/tgagor/template-dockerfiles/pkg/cmd"
+	"github.com/tgagor/template-dockerfiles/pkg/progress"
 )
 
 func TestRunner(t *testing.T) {
@@ -25,3 +32,27 @@ func TestRunner(t *testing.T) {
 		assert.Equal(t, expected[i], input)
 	}
 }
+
+func TestRunLogsCommandEvents(t *testing.T) {
+	var events bytes.Buffer
+	logger := zerolog.New(&events).With().Str("image", "app-alpine").Logger()
+	ctx := progress.WithPhase(logger.WithContext(context.Background()), "build")
+
+	_, err := cmd.New("sh").Arg("-c", "echo broken; exit 3").Run(ctx)
+	require.Error(t, err)
+
+	var failure map[string]any
+	for _, line := range strings.Split(strings.TrimSuffix(events.String(), "\n"), "\n") {
+		var event map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &event))
+		if event["message"] == "Could not run command" {
+			failure = event
+		}
+	}
+	require.NotNil(t, failure, events.String())
+	assert.Equal(t, "app-alpine", failure["image"])
+	assert.Equal(t, "build", failure["phase"])
+	assert.Equal(t, "sh -c echo broken; exit 3", failure["command"])
+	assert.Equal(t, "exit status 3", failure["error"])
+	assert.Contains(t, failure, "duration")
+}
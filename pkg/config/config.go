@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fmt"
 	"io"
 	"os"
 
@@ -16,10 +17,19 @@ type Config struct {
 	GlobalPlatforms []string               `yaml:"platforms"`
 	GlobalOptions   []string               `yaml:"options"`
 	GlobalContext   string                 `yaml:"context"`
+	TagConflicts    string                 `yaml:"tag_conflicts"` // what to do when combinations produce the same tag
 	Images          map[string]ImageConfig `yaml:"images"`
 	ImageOrder      []string               `yaml:"-"` // To preserve the order of images
 }
 
+// Policies for tags produced by more than one combination
+const (
+	TagConflictsError     = "error"
+	TagConflictsWarn      = "warn" // like last-wins, but logged as warnings
+	TagConflictsLastWins  = "last-wins"
+	TagConflictsFirstWins = "first-wins"
+)
+
 type imageLoader struct {
 	Images yaml.Node `yaml:"images"`
 }
@@ -34,6 +44,43 @@ type ImageConfig struct {
 	Platforms  []string          `yaml:"platforms"`
 	Options    []string          `yaml:"options"`
 	Context    string            `yaml:"context"`
+	Files      []string          `yaml:"files"` // additional templates, relative to the build context
+	DependsOn  []Dependency      `yaml:"depends_on"`
+	TagAliases string            `yaml:"tag_aliases"` // "semver" adds 1.2.3, 1.2, 1 and latest for --tag v1.2.3
+}
+
+// Dependency points to another image, optionally limited to combinations
+// with matching variables. Selector values can be templated, e.g.:
+//
+//	depends_on:
+//	  - base
+//	  - jdk:
+//	      java: "{{ .java }}"
+type Dependency struct {
+	Image    string
+	Selector map[string]string
+}
+
+func (d *Dependency) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		d.Image = value.Value
+		return nil
+	case yaml.MappingNode:
+		var m map[string]map[string]string
+		if err := value.Decode(&m); err != nil {
+			return err
+		}
+		if len(m) != 1 {
+			return fmt.Errorf("line %d: depends_on entry should refer to exactly one image", value.Line)
+		}
+		for name, selector := range m {
+			d.Image = name
+			d.Selector = selector
+		}
+		return nil
+	}
+	return fmt.Errorf("line %d: depends_on entry should be an image name or a map of image name to variables", value.Line)
 }
 
 func Load(filename string) (*Config, error) {
@@ -54,6 +101,13 @@ func Load(filename string) (*Config, error) {
 		return nil, err
 	}
 
+	switch cfg.TagConflicts {
+	case "", TagConflictsError, TagConflictsWarn, TagConflictsLastWins, TagConflictsFirstWins:
+	default:
+		return nil, fmt.Errorf("unsupported 'tag_conflicts: %s', use one of: %s, %s, %s, %s",
+			cfg.TagConflicts, TagConflictsError, TagConflictsWarn, TagConflictsLastWins, TagConflictsFirstWins)
+	}
+
 	// Seek to the beginning of the file to read the image order
 	if _, err := file.Seek(0, io.SeekStart); err != nil {
 		log.Error().Err(err).Msg("Error seeking file")
@@ -0,0 +1,12 @@
+package config
+
+// Engine describes capabilities of a build engine, images needing more are
+// refused before anything is built
+type Engine struct {
+	Name          string
+	MultiPlatform bool // builds images for many platforms at once
+	Cache         bool // imports and exports build cache (--cache-from, --cache-to)
+	Secrets       bool // exposes build secrets (--secret)
+	Export        bool // exports images to OCI layout or docker-archive (--output)
+	BuildKit      bool // builds with BuildKit: RUN --mount, heredocs, <Dockerfile>.dockerignore...
+}
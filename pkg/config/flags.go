@@ -1,18 +1,40 @@
 package config
 
+// Formats of logs, selected with --log-format
+const (
+	LogConsole = "console"
+	LogJSON    = "json"
+)
+
 type Flags struct {
-	Build        bool
-	BuildFile    string
-	Delete       bool
-	DryRun       bool
-	Engine       string
-	Image        string
-	NoColor      bool
-	PrintVersion bool
-	Push         bool
-	Squash       bool
-	Tag          string
-	Threads      int
-	Verbose      bool
-	Debug        bool
+	Build           bool
+	BuildFile       string
+	BuildkitAddr    string
+	CacheFrom       []string
+	CacheTo         []string
+	Delete          bool
+	DryRun          bool
+	Engine          string
+	Engines         []Engine // capabilities of known engines, in order of preference
+	Image           string
+	LogDir          string
+	LogFormat       string
+	LogLevel        string
+	NoColor         bool
+	Output          string
+	PrintVersion    bool
+	Progress        string
+	Push            bool
+	PushRetries     int
+	Resume          bool
+	Secrets         []string
+	SkipUnchanged   bool
+	SourceDateEpoch string
+	SplitPlatforms  bool
+	Squash          bool
+	StrictDeps      bool
+	Tag             string
+	Threads         int
+	Verbose         bool
+	Debug           bool
 }
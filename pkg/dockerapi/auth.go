@@ -0,0 +1,136 @@
+package dockerapi
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/distribution/reference"
+)
+
+// docker.io credentials are stored under this legacy key
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+// AuthConfig are credentials sent to the API with push
+type AuthConfig struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	ServerAddress string `json:"serveraddress,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// Encode returns credentials in format of X-Registry-Auth header
+func (a AuthConfig) Encode() (string, error) {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(data), nil
+}
+
+type configFile struct {
+	Auths map[string]struct {
+		Auth          string `json:"auth"`
+		IdentityToken string `json:"identitytoken"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+// ConfigDir returns directory of Docker CLI configuration
+func ConfigDir() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return dir
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".docker")
+}
+
+// LoadAuth reads credentials for registry of the image reference from
+// config.json in configDir, the same way as Docker CLI: from credential
+// helpers or credentials stored in the file. Missing credentials aren't an
+// error, anonymous push might still work.
+func LoadAuth(configDir string, ref string) (AuthConfig, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return AuthConfig{}, fmt.Errorf("invalid reference %q: %w", ref, err)
+	}
+	registry := reference.Domain(named)
+	key := registry
+	if registry == "docker.io" {
+		key = dockerHubAuthKey
+	}
+	auth := AuthConfig{ServerAddress: key}
+
+	data, err := os.ReadFile(filepath.Join(configDir, "config.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return auth, nil
+	} else if err != nil {
+		return auth, err
+	}
+	var cfg configFile
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return auth, fmt.Errorf("can't parse %s: %w", filepath.Join(configDir, "config.json"), err)
+	}
+
+	if helper := cfg.CredHelpers[key]; helper != "" {
+		return credentialHelper(helper, key)
+	}
+	if cfg.CredsStore != "" {
+		return credentialHelper(cfg.CredsStore, key)
+	}
+
+	for server, entry := range cfg.Auths {
+		if server != key && strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://"), "/") != key {
+			continue
+		}
+		auth.IdentityToken = entry.IdentityToken
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return auth, fmt.Errorf("can't decode credentials of %s: %w", server, err)
+			}
+			auth.Username, auth.Password, _ = strings.Cut(string(decoded), ":")
+		}
+		return auth, nil
+	}
+	return auth, nil
+}
+
+// credentialHelper gets credentials using docker-credential-<helper> protocol
+func credentialHelper(helper string, server string) (AuthConfig, error) {
+	auth := AuthConfig{ServerAddress: server}
+
+	var stdout, stderr bytes.Buffer
+	helperCmd := exec.Command("docker-credential-"+helper, "get")
+	helperCmd.Stdin = strings.NewReader(server)
+	helperCmd.Stdout = &stdout
+	helperCmd.Stderr = &stderr
+	if err := helperCmd.Run(); err != nil {
+		// helpers report missing credentials as an error
+		if strings.Contains(stdout.String()+stderr.String(), "credentials not found") {
+			return auth, nil
+		}
+		return auth, fmt.Errorf("credential helper %s failed: %w: %s", helper, err, strings.TrimSpace(stdout.String()+stderr.String()))
+	}
+
+	var creds struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &creds); err != nil {
+		return auth, fmt.Errorf("can't parse output of credential helper %s: %w", helper, err)
+	}
+	if creds.Username == "<token>" {
+		auth.IdentityToken = creds.Secret
+	} else {
+		auth.Username, auth.Password = creds.Username, creds.Secret
+	}
+	return auth, nil
+}
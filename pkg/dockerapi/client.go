@@ -0,0 +1,123 @@
+// Package dockerapi is a minimal client of the Docker Engine API, covering
+// operations needed to build, tag, push, inspect and remove images.
+package dockerapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultHost is used when DOCKER_HOST is not set
+const DefaultHost = "unix:///var/run/docker.sock"
+
+// Client talks to the Docker Engine API over a unix socket or TCP
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// APIError is an error response returned by the Docker Engine API
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("docker API error (%d): %s", e.StatusCode, e.Message)
+}
+
+// NotFound tells if API responded with 404, like for a missing image
+func (e *APIError) NotFound() bool {
+	return e.StatusCode == http.StatusNotFound
+}
+
+// New creates client for host like unix:///var/run/docker.sock or tcp://127.0.0.1:2375
+func New(host string) (*Client, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid docker host %q: %w", host, err)
+	}
+
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		}
+		return &Client{baseURL: "http://docker", httpClient: &http.Client{Transport: transport}}, nil
+	case "tcp", "http":
+		return &Client{baseURL: "http://" + u.Host, httpClient: &http.Client{}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported docker host %q, only unix:// and tcp:// are supported", host)
+	}
+}
+
+// FromEnv creates client for DOCKER_HOST, or the default socket
+func FromEnv() (*Client, error) {
+	host := os.Getenv("DOCKER_HOST")
+	if host == "" {
+		host = DefaultHost
+	}
+	return New(host)
+}
+
+// do sends request and converts error responses to APIError. Caller has to
+// close body of the successful response.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, headers http.Header, body io.Reader) (*http.Response, error) {
+	endpoint := c.baseURL + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+	log.Trace().Str("method", method).Str("url", endpoint).Msg("Docker API")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		defer func() { _ = resp.Body.Close() }()
+		return nil, decodeError(resp)
+	}
+	return resp, nil
+}
+
+func decodeError(resp *http.Response) error {
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return &APIError{StatusCode: resp.StatusCode, Message: err.Error()}
+	}
+	var body struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil || body.Message == "" {
+		body.Message = strings.TrimSpace(string(data))
+	}
+	return &APIError{StatusCode: resp.StatusCode, Message: body.Message}
+}
+
+// closeBody drains and closes response, so connection can be reused
+func closeBody(resp *http.Response) {
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if err := resp.Body.Close(); err != nil {
+		log.Debug().Err(err).Msg("Error closing Docker API response")
+	}
+}
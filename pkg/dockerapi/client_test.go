@@ -0,0 +1,241 @@
+package dockerapi_test
+
+import (
+	"archive/tar"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgagor/template-dockerfiles/pkg/dockerapi"
+)
+
+// fakeAPI starts a fake Docker Engine API and returns client connected to it
+func fakeAPI(t *testing.T, handler http.HandlerFunc) *dockerapi.Client {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	client, err := dockerapi.New("tcp://" + strings.TrimPrefix(server.URL, "http://"))
+	require.NoError(t, err)
+	return client
+}
+
+func tarball(t *testing.T, files map[string]string) io.Reader {
+	t.Helper()
+	var buf strings.Builder
+	tw := tar.NewWriter(&buf)
+	for name, content := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(content))}))
+		_, err := tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return strings.NewReader(buf.String())
+}
+
+func TestBuild(t *testing.T) {
+	t.Parallel()
+
+	client := fakeAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/build", r.URL.Path)
+		assert.Equal(t, []string{"repo.local/app:1", "repo.local/app:latest"}, r.URL.Query()["t"])
+		assert.Equal(t, "Dockerfile", r.URL.Query().Get("dockerfile"))
+		assert.JSONEq(t, `{"maintainer":"me"}`, r.URL.Query().Get("labels"))
+		assert.JSONEq(t, `{"VERSION":"1"}`, r.URL.Query().Get("buildargs"))
+
+		header, err := tar.NewReader(r.Body).Next()
+		require.NoError(t, err)
+		assert.Equal(t, "Dockerfile", header.Name)
+
+		_, _ = io.WriteString(w, `{"stream":"Step 1/1 : FROM alpine\n"}`+"\n")
+		_, _ = io.WriteString(w, `{"aux":{"ID":"sha256:abc"}}`+"\n")
+		_, _ = io.WriteString(w, `{"stream":"Successfully built abc\n"}`+"\n")
+	})
+
+	var progress strings.Builder
+	id, err := client.Build(t.Context(), dockerapi.BuildOptions{
+		Dockerfile: "Dockerfile",
+		Tags:       []string{"repo.local/app:1", "repo.local/app:latest"},
+		Labels:     map[string]string{"maintainer": "me"},
+		BuildArgs:  map[string]string{"VERSION": "1"},
+	}, tarball(t, map[string]string{"Dockerfile": "FROM alpine\n"}), &progress)
+	require.NoError(t, err)
+	assert.Equal(t, "sha256:abc", id)
+	assert.Equal(t, "Step 1/1 : FROM alpine\nSuccessfully built abc\n", progress.String())
+}
+
+func TestBuildErrors(t *testing.T) {
+	t.Parallel()
+
+	// failing instruction is reported in the stream, after 200 OK
+	client := fakeAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"stream":"Step 2/2 : RUN false\n"}`+"\n")
+		_, _ = io.WriteString(w, `{"errorDetail":{"code":1,"message":"The command '/bin/sh -c false' returned a non-zero code: 1"},"error":"The command '/bin/sh -c false' returned a non-zero code: 1"}`+"\n")
+	})
+	_, err := client.Build(t.Context(), dockerapi.BuildOptions{Dockerfile: "Dockerfile"}, tarball(t, nil), io.Discard)
+	var streamErr *dockerapi.StreamError
+	require.ErrorAs(t, err, &streamErr)
+	assert.Equal(t, "The command '/bin/sh -c false' returned a non-zero code: 1", streamErr.Message)
+
+	// invalid requests are rejected with status code
+	client = fakeAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = io.WriteString(w, `{"message":"Cannot locate specified Dockerfile: Dockerfile"}`)
+	})
+	_, err = client.Build(t.Context(), dockerapi.BuildOptions{Dockerfile: "Dockerfile"}, tarball(t, nil), io.Discard)
+	var apiErr *dockerapi.APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusInternalServerError, apiErr.StatusCode)
+	assert.Equal(t, "Cannot locate specified Dockerfile: Dockerfile", apiErr.Message)
+}
+
+func TestTagPushInspectRemove(t *testing.T) {
+	t.Parallel()
+
+	client := fakeAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "POST /images/app-alpine-3.20/tag":
+			assert.Equal(t, "repo.local:5000/app", r.URL.Query().Get("repo"))
+			assert.Equal(t, "3.20", r.URL.Query().Get("tag"))
+			w.WriteHeader(http.StatusCreated)
+		case "POST /images/repo.local:5000/app/push":
+			assert.Equal(t, "3.20", r.URL.Query().Get("tag"))
+			data, err := base64.URLEncoding.DecodeString(r.Header.Get("X-Registry-Auth"))
+			require.NoError(t, err)
+			assert.JSONEq(t, `{"username":"user","password":"secret","serveraddress":"repo.local:5000"}`, string(data))
+			_, _ = io.WriteString(w, `{"status":"Pushing","id":"abc","progress":"[==>  ]"}`+"\n")
+			_, _ = io.WriteString(w, `{"error":"denied: requested access to the resource is denied"}`+"\n")
+		case "GET /images/repo.local:5000/app:3.20/json":
+			_, _ = io.WriteString(w, `{"Id":"sha256:abc","Size":1024,"Config":{"Labels":{"maintainer":"me"}}}`)
+		case "DELETE /images/missing":
+			assert.Equal(t, "1", r.URL.Query().Get("force"))
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = io.WriteString(w, `{"message":"No such image: missing"}`)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+	})
+
+	require.NoError(t, client.Tag(t.Context(), "app-alpine-3.20", "repo.local:5000/app:3.20"))
+
+	var progress strings.Builder
+	err := client.Push(t.Context(), "repo.local:5000/app:3.20", dockerapi.AuthConfig{Username: "user", Password: "secret", ServerAddress: "repo.local:5000"}, &progress)
+	assert.ErrorContains(t, err, "requested access to the resource is denied")
+	assert.Equal(t, "abc: Pushing [==>  ]\n", progress.String())
+
+	inspect, err := client.Inspect(t.Context(), "repo.local:5000/app:3.20")
+	require.NoError(t, err)
+	assert.Equal(t, "sha256:abc", inspect.ID)
+	assert.Equal(t, int64(1024), inspect.Size)
+	assert.Equal(t, "me", inspect.Config.Labels["maintainer"])
+
+	err = client.Remove(t.Context(), "missing")
+	var apiErr *dockerapi.APIError
+	require.True(t, errors.As(err, &apiErr))
+	assert.True(t, apiErr.NotFound())
+}
+
+func TestLoadAuth(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	config := map[string]any{
+		"auths": map[string]any{
+			"https://index.docker.io/v1/": map[string]string{"auth": base64.StdEncoding.EncodeToString([]byte("hub:token"))},
+			"https://repo.local":          map[string]string{"auth": base64.StdEncoding.EncodeToString([]byte("user:pa:ss"))},
+		},
+	}
+	data, err := json.Marshal(config)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "config.json"), data, 0o600))
+
+	auth, err := dockerapi.LoadAuth(dir, "alpine:3.20")
+	require.NoError(t, err)
+	assert.Equal(t, dockerapi.AuthConfig{Username: "hub", Password: "token", ServerAddress: "https://index.docker.io/v1/"}, auth)
+
+	auth, err = dockerapi.LoadAuth(dir, "repo.local/td/app:1")
+	require.NoError(t, err)
+	assert.Equal(t, "user", auth.Username)
+	assert.Equal(t, "pa:ss", auth.Password)
+
+	// anonymous for unknown registries and without config
+	auth, err = dockerapi.LoadAuth(dir, "ghcr.io/tgagor/app:1")
+	require.NoError(t, err)
+	assert.Empty(t, auth.Username)
+	auth, err = dockerapi.LoadAuth(t.TempDir(), "ghcr.io/tgagor/app:1")
+	require.NoError(t, err)
+	assert.Equal(t, "ghcr.io", auth.ServerAddress)
+}
+
+func TestSaveLoad(t *testing.T) {
+	t.Parallel()
+
+	client := fakeAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /images/get":
+			assert.Equal(t, []string{"app:1.0", "app:latest"}, r.URL.Query()["names"])
+			_, _ = io.WriteString(w, "archive")
+		case "POST /images/load":
+			assert.Equal(t, "application/x-tar", r.Header.Get("Content-Type"))
+			body, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			assert.Equal(t, "squashed", string(body))
+			_, _ = io.WriteString(w, `{"stream":"Loaded image: app:1.0\n"}`+"\n")
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+	})
+
+	var archive strings.Builder
+	require.NoError(t, client.Save(t.Context(), []string{"app:1.0", "app:latest"}, &archive))
+	assert.Equal(t, "archive", archive.String())
+
+	var progress strings.Builder
+	require.NoError(t, client.Load(t.Context(), strings.NewReader("squashed"), &progress))
+	assert.Equal(t, "Loaded image: app:1.0\n", progress.String())
+}
+
+func TestLoadAuthCredHelpers(t *testing.T) {
+	// fake docker-credential-test helper knowing only Docker Hub
+	bin := t.TempDir()
+	helper := `#!/bin/sh
+read server
+if [ "$server" = "https://index.docker.io/v1/" ]; then
+  echo '{"Username":"hub","Secret":"token"}'
+else
+  echo "credentials not found in native keychain"
+  exit 1
+fi
+`
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "docker-credential-test"), []byte(helper), 0o755))
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	dir := t.TempDir()
+	config := map[string]any{
+		"credHelpers": map[string]string{
+			"https://index.docker.io/v1/": "test",
+			"ghcr.io":                     "test",
+		},
+	}
+	data, err := json.Marshal(config)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "config.json"), data, 0o600))
+
+	auth, err := dockerapi.LoadAuth(dir, "alpine:3.20")
+	require.NoError(t, err)
+	assert.Equal(t, dockerapi.AuthConfig{Username: "hub", Password: "token", ServerAddress: "https://index.docker.io/v1/"}, auth)
+
+	auth, err = dockerapi.LoadAuth(dir, "ghcr.io/tgagor/app:1")
+	require.NoError(t, err)
+	assert.Equal(t, dockerapi.AuthConfig{ServerAddress: "ghcr.io"}, auth)
+}
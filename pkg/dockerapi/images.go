@@ -0,0 +1,174 @@
+package dockerapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/distribution/reference"
+)
+
+// BuildOptions of the image build, Dockerfile is a path inside of the context archive
+type BuildOptions struct {
+	Dockerfile string
+	Tags       []string
+	Labels     map[string]string
+	BuildArgs  map[string]string
+	Platform   string
+}
+
+// ImageInspect is a subset of image details returned by the API
+type ImageInspect struct {
+	ID       string   `json:"Id"`
+	RepoTags []string `json:"RepoTags"`
+	Size     int64    `json:"Size"`
+	Config   struct {
+		Env        []string            `json:"Env"`
+		Cmd        []string            `json:"Cmd"`
+		Volumes    map[string]struct{} `json:"Volumes"`
+		WorkingDir string              `json:"WorkingDir"`
+		Entrypoint []string            `json:"Entrypoint"`
+		Labels     map[string]string   `json:"Labels"`
+	} `json:"Config"`
+}
+
+// Build sends tar archive of the build context and streams build output to
+// progress. It returns ID of the built image.
+func (c *Client) Build(ctx context.Context, opts BuildOptions, buildContext io.Reader, progress io.Writer) (string, error) {
+	query := url.Values{}
+	query.Set("dockerfile", opts.Dockerfile)
+	query.Set("rm", "1")
+	query.Set("forcerm", "1")
+	for _, tag := range opts.Tags {
+		query.Add("t", tag)
+	}
+	if opts.Platform != "" {
+		query.Set("platform", opts.Platform)
+	}
+	for name, value := range map[string]map[string]string{"labels": opts.Labels, "buildargs": opts.BuildArgs} {
+		if len(value) == 0 {
+			continue
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return "", err
+		}
+		query.Set(name, string(encoded))
+	}
+
+	headers := http.Header{"Content-Type": []string{"application/x-tar"}}
+	resp, err := c.do(ctx, http.MethodPost, "/build", query, headers, buildContext)
+	if err != nil {
+		return "", err
+	}
+	defer closeBody(resp)
+
+	var id string
+	err = readStream(resp.Body, progress, func(aux json.RawMessage) {
+		var result struct {
+			ID string `json:"ID"`
+		}
+		if json.Unmarshal(aux, &result) == nil && result.ID != "" {
+			id = result.ID
+		}
+	})
+	return id, err
+}
+
+// Tag adds tag like registry/name:tag to the source image
+func (c *Client) Tag(ctx context.Context, source string, target string) error {
+	repo, tag, err := splitReference(target)
+	if err != nil {
+		return err
+	}
+	query := url.Values{"repo": {repo}, "tag": {tag}}
+	resp, err := c.do(ctx, http.MethodPost, "/images/"+source+"/tag", query, nil, nil)
+	if err != nil {
+		return err
+	}
+	closeBody(resp)
+	return nil
+}
+
+// Push uploads tagged image to its registry, streaming progress
+func (c *Client) Push(ctx context.Context, ref string, auth AuthConfig, progress io.Writer) error {
+	repo, tag, err := splitReference(ref)
+	if err != nil {
+		return err
+	}
+	encodedAuth, err := auth.Encode()
+	if err != nil {
+		return err
+	}
+
+	headers := http.Header{"X-Registry-Auth": []string{encodedAuth}}
+	resp, err := c.do(ctx, http.MethodPost, "/images/"+repo+"/push", url.Values{"tag": {tag}}, headers, nil)
+	if err != nil {
+		return err
+	}
+	defer closeBody(resp)
+	return readStream(resp.Body, progress, nil)
+}
+
+// Inspect returns details of a local image
+func (c *Client) Inspect(ctx context.Context, name string) (*ImageInspect, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/images/"+name+"/json", nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer closeBody(resp)
+
+	var inspect ImageInspect
+	if err := json.NewDecoder(resp.Body).Decode(&inspect); err != nil {
+		return nil, fmt.Errorf("can't decode inspect of %s: %w", name, err)
+	}
+	return &inspect, nil
+}
+
+// Remove deletes a local image, even if it's tagged more than once
+func (c *Client) Remove(ctx context.Context, name string) error {
+	resp, err := c.do(ctx, http.MethodDelete, "/images/"+name, url.Values{"force": {"1"}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	closeBody(resp)
+	return nil
+}
+
+// Save exports images as docker-archive, like 'docker save'
+func (c *Client) Save(ctx context.Context, names []string, w io.Writer) error {
+	resp, err := c.do(ctx, http.MethodGet, "/images/get", url.Values{"names": names}, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer closeBody(resp)
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// Load imports images from docker-archive, like 'docker load', streaming progress
+func (c *Client) Load(ctx context.Context, archive io.Reader, progress io.Writer) error {
+	headers := http.Header{"Content-Type": []string{"application/x-tar"}}
+	resp, err := c.do(ctx, http.MethodPost, "/images/load", nil, headers, archive)
+	if err != nil {
+		return err
+	}
+	defer closeBody(resp)
+	return readStream(resp.Body, progress, nil)
+}
+
+// splitReference splits reference into repository and tag, like the API expects them
+func splitReference(ref string) (string, string, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid reference %q: %w", ref, err)
+	}
+	tag := "latest"
+	if tagged, ok := named.(reference.Tagged); ok {
+		tag = tagged.Tag()
+	}
+	return reference.FamiliarName(named), tag, nil
+}
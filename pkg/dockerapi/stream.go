@@ -0,0 +1,66 @@
+package dockerapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// StreamError is an error reported inside of a streamed response, after
+// the API already responded with success, like a failing RUN instruction
+type StreamError struct {
+	Message string
+}
+
+func (e *StreamError) Error() string {
+	return e.Message
+}
+
+// message is a single entry of streamed JSON progress
+type message struct {
+	Stream   string `json:"stream"`
+	Status   string `json:"status"`
+	ID       string `json:"id"`
+	Progress string `json:"progress"`
+	Error    string `json:"error"`
+	Detail   struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+	Aux json.RawMessage `json:"aux"`
+}
+
+// readStream decodes streamed JSON messages, writing human readable progress
+// to out and passing aux messages to onAux. It fails on the first error message.
+func readStream(r io.Reader, out io.Writer, onAux func(json.RawMessage)) error {
+	decoder := json.NewDecoder(r)
+	for {
+		var msg message
+		if err := decoder.Decode(&msg); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("can't decode docker API stream: %w", err)
+		}
+
+		if msg.Error != "" || msg.Detail.Message != "" {
+			text := msg.Detail.Message
+			if text == "" {
+				text = msg.Error
+			}
+			return &StreamError{Message: text}
+		}
+		if len(msg.Aux) > 0 && onAux != nil {
+			onAux(msg.Aux)
+		}
+
+		switch {
+		case msg.Stream != "":
+			_, _ = io.WriteString(out, msg.Stream)
+		case msg.Status != "" && msg.ID != "":
+			_, _ = fmt.Fprintf(out, "%s: %s %s\n", msg.ID, msg.Status, msg.Progress)
+		case msg.Status != "":
+			_, _ = fmt.Fprintln(out, msg.Status)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package image
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/rs/zerolog/log"
+)
+
+// SemverAliases is the only supported value of 'tag_aliases'
+const SemverAliases = "semver"
+
+// tagVariable matches tag templates using the version, like "{{ .tag }}-alpine"
+var tagVariable = regexp.MustCompile(`\.tag\b`)
+
+// renderedTag keeps a tag together with the template producing it
+type renderedTag struct {
+	tag      string
+	template string
+}
+
+// tagAliases renders tag templates using {{ .tag }} once more for every
+// alias of the version, so "{{ .tag }}-alpine" with v1.2.3 gives
+// "1.2.3-alpine", "1.2-alpine", "1-alpine" and "latest-alpine".
+func (i *Image) tagAliases() ([]renderedTag, error) {
+	if i.TagAliases != SemverAliases {
+		return nil, nil
+	}
+	versions := semverAliases(i.Version)
+	if len(versions) == 0 {
+		log.Debug().Str("image", i.Name).Str("tag", i.Version).Msg("No aliases for non-semver or pre-release tag")
+		return nil, nil
+	}
+
+	var templates []string
+	for _, tag := range i.tags {
+		if tagVariable.MatchString(tag) {
+			templates = append(templates, tag)
+		}
+	}
+
+	var aliases []renderedTag
+	for _, version := range versions {
+		configSet := i.ConfigSet()
+		configSet["tag"] = version
+		rendered, err := TemplateList(templates, configSet)
+		if err != nil {
+			return nil, err
+		}
+		for n, tag := range rendered {
+			aliases = append(aliases, renderedTag{tag: tag, template: templates[n]})
+		}
+	}
+	return aliases, nil
+}
+
+// semverAliases returns "1.2.3", "1.2", "1" and "latest" for v1.2.3, or
+// nothing for pre-releases and versions not following semver
+func semverAliases(tag string) []string {
+	version, err := semver.StrictNewVersion(strings.TrimPrefix(tag, "v"))
+	if err != nil || version.Prerelease() != "" {
+		return nil
+	}
+
+	major := strconv.FormatUint(version.Major(), 10)
+	minor := major + "." + strconv.FormatUint(version.Minor(), 10)
+	return []string{
+		minor + "." + strconv.FormatUint(version.Patch(), 10),
+		minor,
+		major,
+		"latest",
+	}
+}
@@ -0,0 +1,174 @@
+package image
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/moby/patternmatcher"
+	"github.com/moby/patternmatcher/ignorefile"
+	"github.com/rs/zerolog/log"
+	"github.com/tgagor/template-dockerfiles/pkg/util"
+)
+
+// IgnoreFile returns the ignore file applied to the build context, following
+// BuildKit's rules: <Dockerfile>.dockerignore wins over <context>/.dockerignore.
+func (i *Image) IgnoreFile() string {
+	candidates := []string{
+		i.Dockerignore(),
+		i.Dockerfile + ".dockerignore",
+		filepath.Join(i.BuildContextDir, ".dockerignore"),
+	}
+	for _, candidate := range candidates {
+		if candidate == ".dockerignore" || candidate == "" {
+			continue
+		}
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return candidate
+		}
+	}
+	return ""
+}
+
+func (i *Image) ignorePatterns() (*patternmatcher.PatternMatcher, error) {
+	ignoreFile := i.IgnoreFile()
+	if ignoreFile == "" {
+		return patternmatcher.New(nil)
+	}
+
+	f, err := os.Open(ignoreFile)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Error().Err(err).Str("file", ignoreFile).Msg("Error closing")
+		}
+	}()
+
+	patterns, err := ignorefile.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return patternmatcher.New(patterns)
+}
+
+// generatedFiles are written by td next to Dockerfile templates, which is the
+// build context by default: rendered Dockerfiles with their ignore files, OCI
+// layouts and archives of built images and the state of --resume
+var generatedFiles = []string{
+	"*.Dockerfile",
+	"*.Dockerfile.dockerignore",
+	"*.oci",
+	"*.oci.tar",
+	".td",
+}
+
+func isGenerated(name string) bool {
+	for _, pattern := range generatedFiles {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// WalkContext calls fn for every entry of the build context, that is not
+// excluded by the ignore file or generated by td. Paths passed to fn are slash
+// separated and relative to the build context.
+func (i *Image) WalkContext(fn func(rel string, path string, d fs.DirEntry) error) error {
+	pm, err := i.ignorePatterns()
+	if err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(i.BuildContextDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(i.BuildContextDir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+
+		// outputs of td from previous runs would change the context every time
+		if isGenerated(d.Name()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		excluded, err := pm.MatchesOrParentMatches(rel)
+		if err != nil {
+			return err
+		}
+		if excluded {
+			// whole directory can be skipped, unless some of its content is re-included with !
+			if d.IsDir() && !pm.Exclusions() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		return fn(rel, path, d)
+	})
+}
+
+// StageContext copies the build context into a per combination staging
+// directory with rendered Files, so parallel builds never share them. Only
+// files sent to the builder are copied, raw templates of Files are left out.
+// Images without Files are built from the original context.
+func (i *Image) StageContext() error {
+	if len(i.Files) == 0 || i.StagingDir != "" {
+		return nil
+	}
+	stagingDir, err := os.MkdirTemp("", "td-"+util.SanitizeForFileName(i.UniqName())+"-")
+	if err != nil {
+		return err
+	}
+	log.Debug().Str("source", i.BuildContextDir).Str("staging", stagingDir).Msg("Copying build context")
+
+	err = i.WalkContext(func(rel string, path string, d fs.DirEntry) error {
+		if _, _, ok := i.renderedFile(rel); ok {
+			return nil
+		}
+		return util.CopyEntry(path, filepath.Join(stagingDir, filepath.FromSlash(rel)), d)
+	})
+	for rel, content := range i.renderedFiles {
+		if err != nil {
+			break
+		}
+		destination := filepath.Join(stagingDir, filepath.FromSlash(rel))
+		log.Debug().Str("file", destination).Msg("Generating temporary")
+		if err = os.MkdirAll(filepath.Dir(destination), 0o755); err == nil {
+			err = os.WriteFile(destination, content, 0o644)
+		}
+	}
+	if err != nil {
+		util.RemoveDir(stagingDir)
+		return fmt.Errorf("staging build context of %s failed: %w", i.UniqName(), err)
+	}
+
+	i.StagingDir = stagingDir
+	i.sourceContextDir = i.BuildContextDir
+	i.BuildContextDir = stagingDir
+	return nil
+}
+
+// renderedFile returns path and content that replace template of Files at rel
+func (i *Image) renderedFile(rel string) (string, []byte, bool) {
+	for _, f := range i.Files {
+		if filepath.ToSlash(f) == rel {
+			rendered := strings.TrimSuffix(rel, ".tpl")
+			return rendered, i.renderedFiles[rendered], true
+		}
+	}
+	return "", nil, false
+}
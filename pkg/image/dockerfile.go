@@ -0,0 +1,260 @@
+package image
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/moby/buildkit/frontend/dockerfile/shell"
+	"github.com/rs/zerolog/log"
+)
+
+// ExtractFromDependencies parses the generated Dockerfile and returns all
+// external images it refers to, via FROM, COPY --from and RUN --mount=from.
+// Build stages are resolved, so references to them are not returned.
+func (i *Image) ExtractFromDependencies() ([]string, error) {
+	if i.Dockerfile == "" {
+		return nil, fmt.Errorf("dockerfile path is not set")
+	}
+
+	file, err := os.Open(i.Dockerfile)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if closeErr := file.Close(); closeErr != nil {
+			log.Error().Err(closeErr).Msg("Error closing file")
+		}
+	}()
+
+	result, err := parser.Parse(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", i.Dockerfile, err)
+	}
+
+	return extractDependencies(result, i.BuildArgs)
+}
+
+// flags of instructions, the classic builder doesn't know
+var buildKitFlags = map[string][]string{
+	"run":  {"mount", "network", "security"},
+	"copy": {"link", "parents", "exclude"},
+	"add":  {"link", "parents", "exclude", "checksum", "keep-git-dir"},
+}
+
+// buildKitFeature returns the first feature of the Dockerfile template, that
+// only BuildKit supports, or "" if there's none. Ignore file per Dockerfile
+// counts too, as the classic builder reads only .dockerignore of the context.
+// Templates are checked as they are, before rendering.
+func (i *Image) buildKitFeature() (string, error) {
+	if i.DockerignoreTemplate != "" {
+		return "ignore file per Dockerfile " + i.DockerignoreTemplate, nil
+	}
+	if _, err := os.Stat(i.DockerfileTemplate + ".dockerignore"); err == nil {
+		return "ignore file per Dockerfile " + i.DockerfileTemplate + ".dockerignore", nil
+	}
+
+	content, err := os.ReadFile(i.DockerfileTemplate)
+	if err != nil {
+		return "", err
+	}
+	if syntax, _, _, ok := parser.DetectSyntax(content); ok {
+		return "Dockerfile frontend " + syntax, nil
+	}
+	result, err := parser.Parse(bytes.NewReader(content))
+	if err != nil {
+		return "", nil // reported once rendered
+	}
+	for _, node := range result.AST.Children {
+		instruction := strings.ToLower(node.Value)
+		if len(node.Heredocs) > 0 {
+			return fmt.Sprintf("heredocs in %s (line %d)", strings.ToUpper(instruction), node.StartLine), nil
+		}
+		for _, flag := range node.Flags {
+			name, _, _ := strings.Cut(strings.TrimPrefix(flag, "--"), "=")
+			if slices.Contains(buildKitFlags[instruction], name) {
+				return fmt.Sprintf("%s --%s (line %d)", strings.ToUpper(instruction), name, node.StartLine), nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// AddBase records that the image refers to ref, produced by base image of
+// the same plan
+func (i *Image) AddBase(ref string, base *Image) {
+	if i.bases == nil {
+		i.bases = map[string]*Image{}
+	}
+	i.bases[ref] = base
+}
+
+// Bases returns images of the plan this one refers to, by reference
+func (i *Image) Bases() map[string]*Image {
+	return i.bases
+}
+
+// argScope resolves ARG values the way Docker does: build args override
+// declared defaults, but only for ARGs declared in the current scope.
+type argScope struct {
+	buildArgs map[string]string
+	values    map[string]string
+}
+
+func newArgScope(buildArgs map[string]string) *argScope {
+	return &argScope{buildArgs: buildArgs, values: map[string]string{}}
+}
+
+func (s *argScope) Get(key string) (string, bool) {
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *argScope) Keys() []string {
+	keys := make([]string, 0, len(s.values))
+	for k := range s.values {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// declare handles single ARG word, like NAME or NAME=default
+func (s *argScope) declare(lex *shell.Lex, word string, meta *argScope) error {
+	name, value, hasDefault := strings.Cut(word, "=")
+	if hasDefault {
+		expanded, _, err := lex.ProcessWord(value, s)
+		if err != nil {
+			return err
+		}
+		value = expanded
+	} else if meta != nil {
+		// inside of a stage, ARG without a value brings the global one into scope
+		value, hasDefault = meta.Get(name)
+	}
+	if v, ok := s.buildArgs[name]; ok {
+		value, hasDefault = v, true
+	}
+	if hasDefault {
+		s.values[name] = value
+	} else {
+		s.values[name] = ""
+	}
+	return nil
+}
+
+func extractDependencies(result *parser.Result, buildArgs map[string]string) ([]string, error) {
+	lex := shell.NewLex(result.EscapeToken)
+	metaArgs := newArgScope(buildArgs)
+	var stageArgs *argScope
+
+	stages := map[string]bool{} // stage names, they're not external images
+	stageCount := 0
+	var dependencies []string
+	addDependency := func(ref string) {
+		if ref == "" || strings.EqualFold(ref, "scratch") || slices.Contains(dependencies, ref) {
+			return
+		}
+		dependencies = append(dependencies, ref)
+	}
+	// resolves image reference used as stage or image name in COPY --from, RUN --mount=from
+	isStage := func(ref string) bool {
+		if stages[strings.ToLower(ref)] {
+			return true
+		}
+		index, err := strconv.Atoi(ref)
+		return err == nil && index >= 0 && index < stageCount
+	}
+
+	for _, node := range result.AST.Children {
+		switch strings.ToLower(node.Value) {
+		case "arg":
+			scope, meta := metaArgs, (*argScope)(nil)
+			if stageArgs != nil {
+				scope, meta = stageArgs, metaArgs
+			}
+			for n := node.Next; n != nil; n = n.Next {
+				if err := scope.declare(lex, n.Value, meta); err != nil {
+					return nil, fmt.Errorf("line %d: %w", node.StartLine, err)
+				}
+			}
+
+		case "from":
+			if node.Next == nil {
+				return nil, fmt.Errorf("line %d: FROM requires an image", node.StartLine)
+			}
+			// only global ARGs can be used in FROM
+			ref, _, err := lex.ProcessWord(node.Next.Value, metaArgs)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", node.StartLine, err)
+			}
+			if !isStage(ref) {
+				addDependency(ref)
+			}
+			if alias := node.Next.Next; alias != nil && strings.EqualFold(alias.Value, "as") && alias.Next != nil {
+				stages[strings.ToLower(alias.Next.Value)] = true
+			}
+			stageCount++
+			stageArgs = newArgScope(buildArgs)
+
+		case "copy":
+			if stageArgs == nil {
+				continue
+			}
+			for _, flag := range node.Flags {
+				if value, ok := strings.CutPrefix(flag, "--from="); ok {
+					ref, _, err := lex.ProcessWord(value, stageArgs)
+					if err != nil {
+						return nil, fmt.Errorf("line %d: %w", node.StartLine, err)
+					}
+					if !isStage(ref) {
+						addDependency(ref)
+					}
+				}
+			}
+
+		case "run":
+			if stageArgs == nil {
+				continue
+			}
+			for _, flag := range node.Flags {
+				mount, ok := strings.CutPrefix(flag, "--mount=")
+				if !ok {
+					continue
+				}
+				value, err := mountFrom(mount)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", node.StartLine, err)
+				}
+				ref, _, err := lex.ProcessWord(value, stageArgs)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", node.StartLine, err)
+				}
+				if !isStage(ref) {
+					addDependency(ref)
+				}
+			}
+		}
+	}
+
+	return dependencies, nil
+}
+
+// mountFrom returns value of "from" field of RUN --mount, like:
+// type=bind,from=builder,source=/out,target=/in
+func mountFrom(mount string) (string, error) {
+	fields, err := csv.NewReader(strings.NewReader(mount)).Read()
+	if err != nil {
+		return "", fmt.Errorf("invalid --mount %q: %w", mount, err)
+	}
+	for _, field := range fields {
+		if value, ok := strings.CutPrefix(strings.TrimSpace(field), "from="); ok {
+			return value, nil
+		}
+	}
+	return "", nil
+}
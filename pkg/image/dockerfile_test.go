@@ -0,0 +1,77 @@
+package image_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgagor/template-dockerfiles/pkg/image"
+)
+
+func dependenciesOf(t *testing.T, dockerfile string, buildArgs map[string]string) []string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "Dockerfile")
+	require.NoError(t, os.WriteFile(path, []byte(dockerfile), 0o644))
+
+	img := image.New()
+	img.Dockerfile = path
+	img.BuildArgs = buildArgs
+
+	deps, err := img.ExtractFromDependencies()
+	require.NoError(t, err)
+	return deps
+}
+
+func TestExtractFromDependencies(t *testing.T) {
+	t.Parallel()
+
+	dockerfile := `ARG REGISTRY=repo.local
+ARG ALPINE=3.20
+FROM \
+    --platform=$BUILDPLATFORM \
+    ${REGISTRY}/base:alpine${ALPINE} AS builder
+RUN make
+
+FROM builder AS tester
+RUN make test
+
+FROM scratch
+ARG REGISTRY
+COPY --from=builder /out /out
+COPY --from=0 /out /out2
+COPY --from=${REGISTRY}/tools:latest /bin/tool /bin/tool
+RUN --mount=type=bind,from=repo.local/assets:v1,source=/assets,target=/assets cp -r /assets /srv
+RUN --mount=type=cache,target=/root/.cache true
+`
+
+	deps := dependenciesOf(t, dockerfile, map[string]string{})
+	assert.Equal(t, []string{
+		"repo.local/base:alpine3.20",
+		"repo.local/tools:latest",
+		"repo.local/assets:v1",
+	}, deps)
+}
+
+func TestExtractFromDependenciesArgScoping(t *testing.T) {
+	t.Parallel()
+
+	dockerfile := `ARG BASE=alpine:3.19
+FROM ${BASE}
+# stage ARG is not visible in FROM of the next stage
+ARG BASE=debian:12
+ARG TOOLS=repo.local/tools:1
+COPY --from=$TOOLS /bin /bin
+
+FROM ${BASE}
+`
+
+	// build args override ARG defaults
+	deps := dependenciesOf(t, dockerfile, map[string]string{"BASE": "alpine:3.21"})
+	assert.Equal(t, []string{"alpine:3.21", "repo.local/tools:1"}, deps)
+
+	deps = dependenciesOf(t, dockerfile, map[string]string{})
+	assert.Equal(t, []string{"alpine:3.19", "repo.local/tools:1"}, deps)
+}
@@ -0,0 +1,70 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/tgagor/template-dockerfiles/pkg/config"
+)
+
+// engine returns capabilities of the selected engine, unknown engines support nothing
+func (i *Image) engine() config.Engine {
+	for _, engine := range i.Flags.Engines {
+		if engine.Name == i.Flags.Engine {
+			return engine
+		}
+	}
+	return config.Engine{Name: i.Flags.Engine}
+}
+
+// alternativeEngine returns the preferred engine with a capability, if there's one
+func (i *Image) alternativeEngine(supports func(config.Engine) bool) string {
+	for _, engine := range i.Flags.Engines {
+		if supports(engine) {
+			return engine.Name
+		}
+	}
+	return ""
+}
+
+// validateEngine checks if the selected engine can build the image with given flags
+func (i *Image) validateEngine() error {
+	if !i.Flags.Build {
+		return nil
+	}
+	engine := i.engine()
+
+	unsupported := func(feature string, supports func(config.Engine) bool) error {
+		err := fmt.Sprintf("engine '%s' do not support %s", engine.Name, feature)
+		if alternative := i.alternativeEngine(supports); alternative != "" {
+			err += fmt.Sprintf(", use '%s' instead", alternative)
+		}
+		return errors.New(err)
+	}
+
+	if len(i.Platforms) > 0 && !engine.MultiPlatform {
+		return unsupported("multi-platform builds", func(e config.Engine) bool { return e.MultiPlatform })
+	}
+	if (len(i.Flags.CacheFrom) > 0 || len(i.Flags.CacheTo) > 0) && !engine.Cache {
+		return unsupported("build cache import and export", func(e config.Engine) bool { return e.Cache })
+	}
+	if len(i.Flags.Secrets) > 0 && !engine.Secrets {
+		return unsupported("build secrets", func(e config.Engine) bool { return e.Secrets })
+	}
+	if i.Flags.SplitPlatforms && len(i.Platforms) > 1 && !engine.Export {
+		return unsupported("building platforms separately", func(e config.Engine) bool { return e.Export })
+	}
+	if i.Flags.Output != "" && !engine.Export {
+		return unsupported("exporting images with --output", func(e config.Engine) bool { return e.Export })
+	}
+	if !engine.BuildKit {
+		feature, err := i.buildKitFeature()
+		if err != nil {
+			return err
+		}
+		if feature != "" {
+			return unsupported(feature+", which needs BuildKit", func(e config.Engine) bool { return e.BuildKit })
+		}
+	}
+	return nil
+}
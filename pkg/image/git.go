@@ -0,0 +1,409 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+
+	"github.com/go-git/go-billy/v5"
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/rs/zerolog/log"
+)
+
+// GitInfo describes state of the repository containing the config file.
+type GitInfo struct {
+	Origin     string
+	Revision   string
+	Branch     string // empty in detached HEAD state
+	Tag        string // tag pointing at HEAD, if any
+	Version    string // like git describe --tags --always --dirty
+	Dirty      bool   // uncommitted changes in tracked files
+	CommitTime time.Time
+
+	// nearest tag being a semantic version and number of commits since it
+	SemverTag      string
+	SemverDistance int
+}
+
+// Map exposes git metadata to templates as .git
+func (g *GitInfo) Map() map[string]any {
+	if g == nil {
+		return map[string]any{}
+	}
+	return map[string]any{
+		"origin":           g.Origin,
+		"revision":         g.Revision,
+		"short_revision":   shortHash(g.Revision),
+		"branch":           g.Branch,
+		"tag":              g.Tag,
+		"version":          g.Version,
+		"dirty":            g.Dirty,
+		"commit_time":      g.CommitTime.UTC().Format(time.RFC3339),
+		"commit_timestamp": g.CommitTime.Unix(),
+	}
+}
+
+type gitResult struct {
+	once sync.Once
+	info *GitInfo
+	err  error
+}
+
+// repositories are read once per run, keyed by absolute path
+var gitCache sync.Map
+
+// ReadGit returns metadata of the repository containing path, which is
+// resolved only once per run. Returns nil info if path is not in a repository,
+// on error info holds what could be read.
+func ReadGit(path string) (*GitInfo, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	value, _ := gitCache.LoadOrStore(abs, &gitResult{})
+	result := value.(*gitResult)
+	result.once.Do(func() {
+		result.info, result.err = readGitRepo(abs)
+		if result.err != nil {
+			log.Warn().Err(result.err).Msg("Not being able to read all git repo metadata. Skipping the rest.")
+		} else if result.info != nil {
+			log.Debug().Interface("git", result.info).Str("path", abs).Msg("Read repository")
+		}
+	})
+	return result.info, result.err
+}
+
+func readGitRepo(path string) (*GitInfo, error) {
+	// Open the local git repository, looking in parent directories too
+	repo, err := git.PlainOpenWithOptions(path, &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		if errors.Is(err, git.ErrRepositoryNotExists) {
+			// Return nothing if it's not a Git repository
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open repository: %w", err)
+	}
+	info := &GitInfo{}
+
+	// Get the repository's remotes and find the origin remote
+	remotes, err := repo.Remotes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list remotes: %w", err)
+	}
+	for _, remote := range remotes {
+		if remote.Config().Name == "origin" {
+			if len(remote.Config().URLs) > 0 {
+				info.Origin = remote.Config().URLs[0]
+			}
+			break
+		}
+	}
+
+	// Get the HEAD reference (current branch or commit)
+	head, err := repo.Head()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get HEAD: %w", err)
+	}
+	info.Revision = head.Hash().String()
+	if head.Name().IsBranch() {
+		info.Branch = head.Name().Short()
+	}
+
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		// origin, revision and branch are still good for labels
+		return info, fmt.Errorf("failed to read HEAD commit: %w", err)
+	}
+	info.CommitTime = commit.Committer.When
+
+	// the rest is optional, whatever fails is left empty
+	if info.Dirty, err = isDirty(repo, commit); err != nil {
+		log.Warn().Err(err).Msg("Failed to check for uncommitted changes, assuming there are none")
+	}
+
+	tags, err := tagsByCommit(repo)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to read tags, versions will be based on revision only")
+		tags = map[plumbing.Hash][]string{}
+	}
+	if names := tags[head.Hash()]; len(names) > 0 {
+		info.Tag = names[0]
+	}
+
+	tag, distance, err := nearestTag(commit, func(c *object.Commit) string {
+		if names := tags[c.Hash]; len(names) > 0 {
+			return names[0]
+		}
+		return ""
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to find the nearest tag")
+	}
+	info.Version = describe(tag, distance, info.Revision, info.Dirty)
+
+	info.SemverTag, info.SemverDistance, err = nearestTag(commit, func(c *object.Commit) string {
+		return highestSemver(tags[c.Hash])
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to find the nearest semver tag")
+	}
+
+	return info, nil
+}
+
+var semverTag = regexp.MustCompile(`^v?\d+\.\d+\.\d+`)
+
+// highestSemver picks the highest semantic version from tags of a single commit
+func highestSemver(tags []string) string {
+	var best string
+	var bestVersion *semver.Version
+	for _, tag := range tags {
+		if !semverTag.MatchString(tag) {
+			continue
+		}
+		version, err := semver.NewVersion(tag)
+		if err != nil {
+			continue
+		}
+		if bestVersion == nil || version.GreaterThan(bestVersion) {
+			best, bestVersion = tag, version
+		}
+	}
+	return best
+}
+
+// SemanticVersion derives version from the nearest semver tag. Tagged commits
+// use the tag as is, later commits get a pre-release of the next patch version
+// with number of commits and revision, like v1.2.4-dev.5.gabc1234.
+// Uncommitted changes are marked with "dirty".
+func (g *GitInfo) SemanticVersion() string {
+	prefix := "v"
+	base := semver.New(0, 0, 0, "", "")
+	if g.SemverTag != "" {
+		// already validated by highestSemver
+		base, _ = semver.NewVersion(g.SemverTag)
+		if !strings.HasPrefix(g.SemverTag, "v") {
+			prefix = ""
+		}
+	}
+
+	var prerelease []string
+	switch {
+	case g.SemverTag == "":
+		prerelease = append(prerelease, "dev", "g"+shortHash(g.Revision))
+	case g.SemverDistance == 0:
+		if base.Prerelease() != "" {
+			prerelease = append(prerelease, base.Prerelease())
+		}
+	case base.Prerelease() != "":
+		// v1.3.0-rc.1 is followed by v1.3.0-rc.1.dev.5.gabc1234
+		prerelease = append(prerelease, base.Prerelease(), "dev", strconv.Itoa(g.SemverDistance), "g"+shortHash(g.Revision))
+	default:
+		next := base.IncPatch()
+		base = &next
+		prerelease = append(prerelease, "dev", strconv.Itoa(g.SemverDistance), "g"+shortHash(g.Revision))
+	}
+	if g.Dirty {
+		prerelease = append(prerelease, "dirty")
+	}
+
+	version := fmt.Sprintf("%s%d.%d.%d", prefix, base.Major(), base.Minor(), base.Patch())
+	if len(prerelease) > 0 {
+		version += "-" + strings.Join(prerelease, ".")
+	}
+	return version
+}
+
+// describe formats version the way git describe --tags --always --dirty does
+func describe(tag string, distance int, revision string, dirty bool) string {
+	version := shortHash(revision)
+	if tag != "" {
+		version = tag
+		if distance > 0 {
+			version = fmt.Sprintf("%s-%d-g%s", tag, distance, shortHash(revision))
+		}
+	}
+	if dirty {
+		version += "-dirty"
+	}
+	return version
+}
+
+func shortHash(revision string) string {
+	if len(revision) > 7 {
+		return revision[:7]
+	}
+	return revision
+}
+
+// isDirty reports uncommitted changes in tracked files, untracked files are
+// ignored like by git describe. Like git, files with size and modification
+// time recorded in the index are trusted and only the rest is hashed, as
+// worktree status of go-git reads every file.
+func isDirty(repo *git.Repository, head *object.Commit) (bool, error) {
+	worktree, err := repo.Worktree()
+	if errors.Is(err, git.ErrIsBareRepository) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return false, fmt.Errorf("failed to read index: %w", err)
+	}
+	tree, err := head.Tree()
+	if err != nil {
+		return false, fmt.Errorf("failed to read HEAD tree: %w", err)
+	}
+
+	committed := map[string]*object.File{}
+	err = tree.Files().ForEach(func(f *object.File) error {
+		committed[f.Name] = f
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to read HEAD tree: %w", err)
+	}
+
+	staged := 0
+	for _, entry := range idx.Entries {
+		if entry.Mode == filemode.Submodule {
+			continue
+		}
+		staged++
+		file, ok := committed[entry.Name]
+		if !ok || file.Hash != entry.Hash || file.Mode != entry.Mode {
+			return true, nil
+		}
+		modified, err := isModified(worktree.Filesystem, entry)
+		if err != nil || modified {
+			return modified, err
+		}
+	}
+	// files deleted from the index
+	return staged != len(committed), nil
+}
+
+// isModified compares file in the worktree with its index entry
+func isModified(fs billy.Filesystem, entry *index.Entry) (bool, error) {
+	info, err := fs.Lstat(entry.Name)
+	if errors.Is(err, os.ErrNotExist) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if mode, err := filemode.NewFromOSFileMode(info.Mode()); err != nil || mode != entry.Mode {
+		return true, nil
+	}
+	if info.Size() != int64(entry.Size) {
+		return true, nil
+	}
+	if info.ModTime().Equal(entry.ModifiedAt) {
+		return false, nil
+	}
+
+	var content []byte
+	if entry.Mode == filemode.Symlink {
+		target, err := fs.Readlink(entry.Name)
+		if err != nil {
+			return false, err
+		}
+		content = []byte(target)
+	} else {
+		file, err := fs.Open(entry.Name)
+		if err != nil {
+			return false, err
+		}
+		defer file.Close()
+		if content, err = io.ReadAll(file); err != nil {
+			return false, err
+		}
+	}
+	return plumbing.ComputeHash(plumbing.BlobObject, content) != entry.Hash, nil
+}
+
+// tagsByCommit maps commits to names of tags pointing at them, annotated tags are peeled
+func tagsByCommit(repo *git.Repository) (map[plumbing.Hash][]string, error) {
+	tags := map[plumbing.Hash][]string{}
+	refs, err := repo.Tags()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tags: %w", err)
+	}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		hash := ref.Hash()
+		if annotated, err := repo.TagObject(hash); err == nil {
+			commit, err := annotated.Commit()
+			if err != nil {
+				return nil // tag of something else than a commit
+			}
+			hash = commit.Hash
+		}
+		tags[hash] = append(tags[hash], ref.Name().Short())
+		return nil
+	})
+	return tags, err
+}
+
+// nearestTag walks history breadth first from HEAD, returning the first tag
+// accepted by match and number of commits between it and HEAD.
+func nearestTag(head *object.Commit, match func(*object.Commit) string) (string, int, error) {
+	type step struct {
+		commit   *object.Commit
+		distance int
+	}
+	seen := map[plumbing.Hash]bool{head.Hash: true}
+	queue := []step{{head, 0}}
+
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		if tag := match(current.commit); tag != "" {
+			return tag, current.distance, nil
+		}
+
+		err := current.commit.Parents().ForEach(func(parent *object.Commit) error {
+			if !seen[parent.Hash] {
+				seen[parent.Hash] = true
+				queue = append(queue, step{parent, current.distance + 1})
+			}
+			return nil
+		})
+		if err != nil {
+			return "", 0, err
+		}
+	}
+	return "", 0, nil
+}
+
+// AutoTag resolves version for "--tag auto" from git repository at path
+func AutoTag(path string) (string, error) {
+	gitInfo, err := ReadGit(path)
+	if err != nil {
+		return "", err
+	}
+	if gitInfo == nil {
+		return "", fmt.Errorf("%s is not in a git repository", path)
+	}
+	return gitInfo.SemanticVersion(), nil
+}
+
+// commitTimestamp returns Unix time of the HEAD commit as string
+func (g *GitInfo) commitTimestamp() string {
+	return strconv.FormatInt(g.CommitTime.Unix(), 10)
+}
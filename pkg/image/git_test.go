@@ -0,0 +1,204 @@
+package image_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgagor/template-dockerfiles/pkg/image"
+)
+
+// initRepo creates a repository with two commits, where the first one is tagged as v1.0.0
+func initRepo(t *testing.T) (string, *git.Repository, *git.Worktree) {
+	t.Helper()
+
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false)
+	require.NoError(t, err)
+	worktree, err := repo.Worktree()
+	require.NoError(t, err)
+
+	commit := func(content string, when time.Time) plumbing.Hash {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "build.yaml"), []byte(content), 0o644))
+		_, err := worktree.Add("build.yaml")
+		require.NoError(t, err)
+		hash, err := worktree.Commit(content, &git.CommitOptions{
+			Author: &object.Signature{Name: "td", Email: "td@example.com", When: when},
+		})
+		require.NoError(t, err)
+		return hash
+	}
+
+	first := commit("first", time.Unix(1700000000, 0))
+	_, err = repo.CreateTag("v1.0.0", first, &git.CreateTagOptions{
+		Tagger:  &object.Signature{Name: "td", Email: "td@example.com", When: time.Unix(1700000000, 0)},
+		Message: "v1.0.0",
+	})
+	require.NoError(t, err)
+	commit("second", time.Unix(1700000100, 0))
+
+	return dir, repo, worktree
+}
+
+func TestReadGit(t *testing.T) {
+	t.Parallel()
+
+	dir, repo, _ := initRepo(t)
+	head, err := repo.Head()
+	require.NoError(t, err)
+	short := head.Hash().String()[:7]
+
+	// read from a subdirectory of the repository
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "images"), 0o755))
+	info, err := image.ReadGit(filepath.Join(dir, "images"))
+	require.NoError(t, err)
+	require.NotNil(t, info)
+
+	assert.Equal(t, head.Hash().String(), info.Revision)
+	assert.Equal(t, "master", info.Branch)
+	assert.Empty(t, info.Tag)
+	assert.False(t, info.Dirty)
+	assert.Equal(t, "v1.0.0-1-g"+short, info.Version)
+	assert.Equal(t, int64(1700000100), info.CommitTime.Unix())
+
+	// cached for the whole run
+	again, err := image.ReadGit(filepath.Join(dir, "images"))
+	require.NoError(t, err)
+	assert.Same(t, info, again)
+
+	vars := info.Map()
+	assert.Equal(t, short, vars["short_revision"])
+	assert.Equal(t, "2023-11-14T22:15:00Z", vars["commit_time"])
+}
+
+func TestReadGitTaggedAndDirty(t *testing.T) {
+	t.Parallel()
+
+	dir, repo, _ := initRepo(t)
+	head, err := repo.Head()
+	require.NoError(t, err)
+	_, err = repo.CreateTag("v1.1.0", head.Hash(), nil)
+	require.NoError(t, err)
+
+	// untracked files don't make the tree dirty, modified ones do
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "untracked"), []byte("new"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "build.yaml"), []byte("modified"), 0o644))
+
+	info, err := image.ReadGit(dir)
+	require.NoError(t, err)
+	assert.Equal(t, "v1.1.0", info.Tag)
+	assert.True(t, info.Dirty)
+	assert.Equal(t, "v1.1.0-dirty", info.Version)
+}
+
+func TestReadGitDirty(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		change func(t *testing.T, dir string, worktree *git.Worktree)
+		dirty  bool
+	}{
+		{"clean", func(t *testing.T, dir string, worktree *git.Worktree) {}, false},
+		{"touched only", func(t *testing.T, dir string, worktree *git.Worktree) {
+			later := time.Now().Add(time.Hour)
+			require.NoError(t, os.Chtimes(filepath.Join(dir, "build.yaml"), later, later))
+		}, false},
+		{"same size", func(t *testing.T, dir string, worktree *git.Worktree) {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "build.yaml"), []byte("secomd"), 0o644))
+		}, true},
+		{"staged", func(t *testing.T, dir string, worktree *git.Worktree) {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "build.yaml"), []byte("staged"), 0o644))
+			_, err := worktree.Add("build.yaml")
+			require.NoError(t, err)
+		}, true},
+		{"deleted", func(t *testing.T, dir string, worktree *git.Worktree) {
+			require.NoError(t, os.Remove(filepath.Join(dir, "build.yaml")))
+		}, true},
+		{"removed from index", func(t *testing.T, dir string, worktree *git.Worktree) {
+			_, err := worktree.Remove("build.yaml")
+			require.NoError(t, err)
+		}, true},
+		{"executable", func(t *testing.T, dir string, worktree *git.Worktree) {
+			require.NoError(t, os.Chmod(filepath.Join(dir, "build.yaml"), 0o755))
+		}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			dir, _, worktree := initRepo(t)
+			tt.change(t, dir, worktree)
+
+			info, err := image.ReadGit(dir)
+			require.NoError(t, err)
+			assert.Equal(t, tt.dirty, info.Dirty)
+		})
+	}
+}
+
+func TestReadGitOutsideOfRepository(t *testing.T) {
+	t.Parallel()
+
+	info, err := image.ReadGit(t.TempDir())
+	assert.NoError(t, err)
+	assert.Nil(t, info)
+	assert.Empty(t, info.Map())
+}
+
+func TestSemanticVersion(t *testing.T) {
+	t.Parallel()
+
+	revision := "abc1234def5678"
+	tests := []struct {
+		name     string
+		info     image.GitInfo
+		expected string
+	}{
+		{"tagged", image.GitInfo{SemverTag: "v1.2.3", Revision: revision}, "v1.2.3"},
+		{"tagged without prefix", image.GitInfo{SemverTag: "1.2.3", Revision: revision}, "1.2.3"},
+		{"tagged pre-release", image.GitInfo{SemverTag: "v1.3.0-rc.1", Revision: revision}, "v1.3.0-rc.1"},
+		{"after tag", image.GitInfo{SemverTag: "v1.2.3", SemverDistance: 5, Revision: revision}, "v1.2.4-dev.5.gabc1234"},
+		{"after pre-release", image.GitInfo{SemverTag: "v1.3.0-rc.1", SemverDistance: 2, Revision: revision}, "v1.3.0-rc.1.dev.2.gabc1234"},
+		{"tagged dirty", image.GitInfo{SemverTag: "v1.2.3", Revision: revision, Dirty: true}, "v1.2.3-dirty"},
+		{"after tag dirty", image.GitInfo{SemverTag: "v1.2.3", SemverDistance: 1, Revision: revision, Dirty: true}, "v1.2.4-dev.1.gabc1234.dirty"},
+		{"no tags", image.GitInfo{Revision: revision}, "v0.0.0-dev.gabc1234"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.info.SemanticVersion())
+		})
+	}
+}
+
+func TestAutoTag(t *testing.T) {
+	t.Parallel()
+
+	dir, repo, _ := initRepo(t)
+	head, err := repo.Head()
+	require.NoError(t, err)
+	first, err := repo.CommitObject(head.Hash())
+	require.NoError(t, err)
+	parent, err := first.Parent(0)
+	require.NoError(t, err)
+	// not a semantic version, so v1.0.0 stays the nearest one
+	_, err = repo.CreateTag("nightly", head.Hash(), nil)
+	require.NoError(t, err)
+	_, err = repo.CreateTag("v0.9.0", parent.Hash, nil)
+	require.NoError(t, err)
+
+	tag, err := image.AutoTag(dir)
+	require.NoError(t, err)
+	assert.Equal(t, "v1.0.1-dev.1.g"+head.Hash().String()[:7], tag)
+
+	_, err = image.AutoTag(t.TempDir())
+	assert.Error(t, err)
+}
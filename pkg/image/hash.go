@@ -0,0 +1,133 @@
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"slices"
+
+	"github.com/rs/zerolog/log"
+)
+
+// InputHashLabel stores the input hash in the image, so unchanged images can be detected
+const InputHashLabel = "io.github.tgagor.template-dockerfiles.input-hash"
+
+// labels that change on every run, or are derived from the hash itself
+var unhashedLabels = []string{
+	"org.opencontainers.image.created",
+	InputHashLabel,
+}
+
+// InputHash returns a deterministic hash of everything that goes into the build
+// of this image, combined with hashes of the images it depends on.
+func (i *Image) InputHash(dependencyHashes []string) (string, error) {
+	dockerfile, err := os.ReadFile(i.Dockerfile)
+	if err != nil {
+		return "", err
+	}
+
+	labels := maps.Clone(i.Labels)
+	for _, l := range unhashedLabels {
+		delete(labels, l)
+	}
+	buildContext, err := i.contextHash()
+	if err != nil {
+		return "", err
+	}
+	deps := slices.Clone(dependencyHashes)
+	slices.Sort(deps)
+
+	var engine string
+	var squash bool
+	if i.Flags != nil {
+		engine, squash = i.Flags.Engine, i.Flags.Squash
+	}
+
+	// json.Marshal sorts map keys, which makes it stable
+	input, err := json.Marshal(struct {
+		Dockerfile   string
+		Context      string
+		BuildArgs    map[string]string
+		Labels       map[string]string
+		Platforms    []string
+		Options      []string
+		Tags         []string
+		Engine       string
+		Squash       bool
+		Dependencies []string
+	}{
+		Dockerfile:   string(dockerfile),
+		Context:      buildContext,
+		BuildArgs:    i.BuildArgs,
+		Labels:       labels,
+		Platforms:    i.Platforms,
+		Options:      i.Options,
+		Tags:         i.Tags(),
+		Engine:       engine,
+		Squash:       squash,
+		Dependencies: deps,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(input)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// SetInputHash stores the hash as a label of the image.
+func (i *Image) SetInputHash(hash string) {
+	i.Labels[InputHashLabel] = hash
+}
+
+// contextHash hashes paths, modes and content of all files sent to the builder,
+// so renaming, chmod or editing of any file changes it. Files are hashed as
+// rendered, so changes of the variables they use change it too.
+func (i *Image) contextHash() (string, error) {
+	h := sha256.New()
+	err := i.WalkContext(func(rel string, path string, d fs.DirEntry) error {
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if rendered, content, ok := i.renderedFile(rel); ok {
+			// templates of Files are sent rendered, see StageContext
+			fmt.Fprintf(h, "%s\x00%o\x00", rendered, os.FileMode(0o644))
+			_, err := h.Write(content)
+			return err
+		}
+		fmt.Fprintf(h, "%s\x00%o\x00", rel, info.Mode())
+
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%s\x00", link)
+		case d.Type().IsRegular():
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if err := f.Close(); err != nil {
+					log.Error().Err(err).Str("file", path).Msg("Error closing")
+				}
+			}()
+			if _, err := io.Copy(h, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,57 @@
+package image_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgagor/template-dockerfiles/pkg/config"
+	"github.com/tgagor/template-dockerfiles/pkg/image"
+)
+
+func TestInputHash(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	write := func(name string, content string) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+	write("Dockerfile", "FROM alpine\nCOPY . /app\n")
+	write(".dockerignore", "logs/\n")
+	write("app.conf", "port=8080\n")
+
+	cfg := &config.Config{
+		Images: map[string]config.ImageConfig{
+			"app": {Dockerfile: "Dockerfile", Tags: []string{"app"}},
+		},
+	}
+	flags := &config.Flags{BuildFile: filepath.Join(dir, "build.yaml")}
+	hashOf := func(deps ...string) string {
+		img := image.From("app", cfg, map[string]any{}, flags)
+		require.NoError(t, img.Render())
+		hash, err := img.InputHash(deps)
+		require.NoError(t, err)
+		return hash
+	}
+
+	initial := hashOf()
+	assert.Regexp(t, "^sha256:[0-9a-f]{64}$", initial)
+
+	// stable between runs, even if created label differs
+	assert.Equal(t, initial, hashOf())
+
+	// order of dependencies doesn't matter, but their hashes do
+	assert.Equal(t, hashOf("a", "b"), hashOf("b", "a"))
+	assert.NotEqual(t, initial, hashOf("a"))
+
+	// ignored files don't matter
+	write("logs/build.log", "whatever")
+	assert.Equal(t, initial, hashOf())
+
+	// but any other change in build context does
+	write("app.conf", "port=8081\n")
+	assert.NotEqual(t, initial, hashOf())
+}
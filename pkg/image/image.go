@@ -1,7 +1,10 @@
 package image
 
 import (
-	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"maps"
 	"os"
@@ -9,6 +12,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"slices"
 	"sort"
 	"strings"
 
@@ -17,21 +21,37 @@ import (
 	"github.com/tgagor/template-dockerfiles/pkg/util"
 )
 
+// maxNameLength caps UniqName and generated Dockerfile names for combinations
+// with many variables, it's well below limits of tags and file names
+const maxNameLength = 100
+
 type Image struct {
-	Name               string
-	Registry           string
-	Prefix             string
-	DockerfileTemplate string
-	Dockerfile         string
-	BuildContextDir    string
-	Variables          map[string]any
-	tags               []string
-	Version            string
-	Labels             map[string]string
-	BuildArgs          map[string]string
-	Platforms          []string
-	Options            []string
-	Flags              *config.Flags
+	Name                 string
+	Registry             string
+	Prefix               string
+	DockerfileTemplate   string
+	Dockerfile           string
+	DockerignoreTemplate string // optional, rendered next to Dockerfile as <Dockerfile>.dockerignore
+	BuildContextDir      string
+	StagingDir           string // per combination copy of the build context with rendered Files, see StageContext
+	Files                []string
+	renderedFiles        map[string][]byte // content of Files by path in the build context, without .tpl
+	sourceContextDir     string            // BuildContextDir replaced by StagingDir
+	DependsOn            []config.Dependency // explicit dependencies, selectors are templated by Render
+	Variables            map[string]any
+	tags                 []string
+	aliases              []string // subset of tags generated by TagAliases
+	disambiguated        bool     // UniqName is suffixed with hash of the combination
+	TagAliases           string
+	Version              string
+	Labels               map[string]string
+	BuildArgs            map[string]string
+	Platforms            []string
+	Options              []string
+	Flags                *config.Flags
+	Git                  *GitInfo          // nil outside of git repository
+	parent               *Image            // image split into platforms, see ForPlatform
+	bases                map[string]*Image // images of the plan referred by FROM, see AddBase
 }
 
 func New() *Image {
@@ -42,6 +62,7 @@ func New() *Image {
 		Platforms: []string{},
 		tags:      []string{},
 		Variables: map[string]any{},
+		Files:     []string{},
 	}
 }
 
@@ -69,12 +90,23 @@ func From(name string, cfg *config.Config, configSet map[string]any, flags *conf
 		img.BuildContextDir = cfg.Images[name].Context
 	}
 
+	// collect additional templates rendered into the build context
+	img.Files = append(img.Files, cfg.Images[name].Files...)
+
+	// collect explicit dependencies
+	for _, dep := range cfg.Images[name].DependsOn {
+		img.DependsOn = append(img.DependsOn, config.Dependency{Image: dep.Image, Selector: maps.Clone(dep.Selector)})
+	}
+
 	// collect tags
 	img.tags = append(img.tags, cfg.Images[name].Tags...) // non templated yet
+	img.TagAliases = cfg.Images[name].TagAliases
 
 	// collect labels
 	maps.Copy(img.Labels, cfg.GlobalLabels)
-	maps.Copy(img.Labels, collectOCILabels(img.ConfigSet()))
+	// git metadata is read once per run, errors are already reported
+	img.Git, _ = ReadGit(filepath.Dir(flags.BuildFile))
+	maps.Copy(img.Labels, collectOCILabels(img.ConfigSet(), createdTime(flags.SourceDateEpoch), img.Git))
 	img.SetMaintainer(cfg.Maintainer)
 	if flags.Tag != "" {
 		img.Labels["org.opencontainers.image.version"] = flags.Tag
@@ -82,6 +114,9 @@ func From(name string, cfg *config.Config, configSet map[string]any, flags *conf
 	maps.Copy(img.Labels, cfg.Images[name].Labels) // non templated yet
 
 	// collect build arguments
+	if flags.SourceDateEpoch != "" {
+		img.BuildArgs["SOURCE_DATE_EPOCH"] = flags.SourceDateEpoch
+	}
 	maps.Copy(img.BuildArgs, cfg.Images[name].BuildArgs)
 
 	// set Dockerfile and build context
@@ -97,8 +132,11 @@ func (i *Image) Validate() error {
 	if i.BuildContextDir == "" {
 		return fmt.Errorf("BuildContextDir is required")
 	}
-	if len(i.Platforms) > 0 && i.Flags.Engine != "buildx" && i.Flags.Build {
-		return fmt.Errorf("engine '%s' do not support multi-platform builds, use 'buildx' instead", i.Flags.Engine)
+	if err := i.validateEngine(); err != nil {
+		return err
+	}
+	if err := i.validateOutput(); err != nil {
+		return err
 	}
 
 	// check if users don't try to override reserved keys
@@ -121,39 +159,80 @@ func (i *Image) Validate() error {
 		return fmt.Errorf("no 'tags' defined for %s - add 'tags' block to continue", i.Name)
 	}
 
+	if i.TagAliases != "" && i.TagAliases != SemverAliases {
+		return fmt.Errorf("unsupported 'tag_aliases: %s' for image %s, only '%s' is allowed", i.TagAliases, i.Name, SemverAliases)
+	}
+
 	// validate Dockerfile path
 	if i.Dockerfile == "" {
 		return fmt.Errorf("required Dockerfile is missing for image %s", i.Name)
 	}
 
+	// validate additional templates, they have to stay inside of the build context
+	for _, f := range i.Files {
+		if !strings.HasSuffix(f, ".tpl") {
+			return fmt.Errorf("file '%s' of image %s is not a template, only '.tpl' files can be listed under 'files'", f, i.Name)
+		}
+		if !filepath.IsLocal(f) {
+			return fmt.Errorf("file '%s' of image %s has to be a relative path inside of the build context", f, i.Name)
+		}
+	}
+
 	return nil
 }
 
+// Render templates tags, labels, build args, options and the Dockerfile.
+// Errors from all fields are collected, so every broken template is reported at once.
 func (i *Image) Render() error {
-	// template templatedTags
+	var errs []error
+
+	// template tags
 	if templatedTags, err := TemplateList(i.tags, i.ConfigSet()); err != nil {
-		return err
+		errs = append(errs, withContext(err, i.Name, "tags"))
+	} else if aliases, err := i.tagAliases(); err != nil {
+		errs = append(errs, withContext(err, i.Name, "tags"))
 	} else {
+		templates := slices.Clone(i.tags)
 		i.tags = templatedTags
+		for _, alias := range aliases {
+			if !slices.Contains(i.tags, alias.tag) {
+				i.tags = append(i.tags, alias.tag)
+				i.aliases = append(i.aliases, alias.tag)
+				templates = append(templates, alias.template)
+			}
+		}
+		errs = append(errs, i.validateTags(templates)...)
 	}
 
 	// template labels
 	if templatedLabels, err := TemplateMap(i.Labels, i.ConfigSet()); err != nil {
-		return err
+		errs = append(errs, withContext(err, i.Name, "labels"))
 	} else {
 		maps.Copy(i.Labels, templatedLabels)
 	}
 
 	// template build args
 	if templatedBuildArgs, err := TemplateMap(i.BuildArgs, i.ConfigSet()); err != nil {
-		return err
+		errs = append(errs, withContext(err, i.Name, "args"))
 	} else {
 		maps.Copy(i.BuildArgs, templatedBuildArgs)
 	}
 
+	// template selectors of explicit dependencies
+	for n, dep := range i.DependsOn {
+		if len(dep.Selector) == 0 {
+			continue
+		}
+		if templatedSelector, err := TemplateMap(dep.Selector, i.ConfigSet()); err != nil {
+			errs = append(errs, withContext(err, i.Name, "depends_on"))
+		} else {
+			i.DependsOn[n].Selector = templatedSelector
+		}
+	}
+
 	// template options
 	if templatedOptions, err := TemplateList(i.Options, i.ConfigSet()); err != nil {
-		return err
+		errs = append(errs, withContext(err, i.Name, "options"))
 	} else {
 		i.Options = templatedOptions
 	}
@@ -163,13 +242,46 @@ func (i *Image) Render() error {
 		log.Debug().Str("dockerfile", i.Dockerfile).Msg("Generating temporary")
 		if err := TemplateFile(i.DockerfileTemplate, i.Dockerfile, i.ConfigSet()); err != nil {
 			log.Error().Err(err).Str("dockerfile", i.Dockerfile).Msg("Failed to template Dockerfile")
-			return err
+			errs = append(errs, withContext(err, i.Name, "dockerfile"))
+		}
+	}
+
+	// template .dockerignore dedicated to the generated Dockerfile
+	if i.DockerignoreTemplate != "" {
+		log.Debug().Str("dockerignore", i.Dockerignore()).Msg("Generating temporary")
+		if err := TemplateFile(i.DockerignoreTemplate, i.Dockerignore(), i.ConfigSet()); err != nil {
+			errs = append(errs, withContext(err, i.Name, "dockerignore"))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	// template additional files, they're put into the build context by StageContext
+	if len(i.Files) > 0 {
+		if err := i.renderFiles(); err != nil {
+			return withContext(err, i.Name, "files")
 		}
 	}
 
 	return nil
 }
 
+// renderFiles templates all Files in memory, it's cheap enough to do it for
+// every combination and reports broken templates before anything is built
+func (i *Image) renderFiles() error {
+	i.renderedFiles = make(map[string][]byte, len(i.Files))
+	for _, f := range i.Files {
+		content, err := RenderFile(filepath.Join(i.BuildContextDir, f), i.ConfigSet())
+		if err != nil {
+			return err
+		}
+		i.renderedFiles[filepath.ToSlash(strings.TrimSuffix(f, ".tpl"))] = content
+	}
+	return nil
+}
+
 func (i *Image) ConfigSet() map[string]any {
 	configSet := make(map[string]any)
 	configSet["image"] = i.Name
@@ -179,6 +291,7 @@ func (i *Image) ConfigSet() map[string]any {
 	configSet["platforms"] = i.Platforms
 	maps.Copy(configSet, i.Variables)
 	configSet["env"] = EnvVariables()
+	configSet["git"] = i.Git.Map()
 	configSet["tag"] = i.Version
 	configSet["tags"] = i.tags
 	configSet["labels"] = i.Labels
@@ -191,6 +304,7 @@ func (i *Image) ConfigSet() map[string]any {
 func (i *Image) Representation() map[string]any {
 	repr := i.ConfigSet()
 	delete(repr, "env")
+	delete(repr, "git")
 	if !i.Flags.Verbose {
 		delete(repr, "labels")
 		delete(repr, "maintainer")
@@ -247,10 +361,44 @@ func (i *Image) String() string {
 }
 
 func (i *Image) UniqName() string {
-	// name is required to avoid collisions between images or
-	// when variables are not defined to have actual image name
 	// ERROR: invalid tag "timezone-UTC": repository name must be lowercase
-	return strings.ToLower(strings.Trim(fmt.Sprintf("%s-%s", i.Name, generateCombinationString(i.ConfigSet())), "-"))
+	return strings.ToLower(i.combinationName())
+}
+
+// combinationName joins image name with sanitized variables. Name is required
+// to avoid collisions between images or when variables are not defined to have
+// actual image name. Long names are shortened and suffixed with a hash of the
+// combination, the same happens for all images when Disambiguate was called.
+func (i *Image) combinationName() string {
+	name := strings.Trim(fmt.Sprintf("%s-%s", i.Name, generateCombinationString(i.ConfigSet())), "-")
+	if !i.disambiguated && len(name) <= maxNameLength {
+		return name
+	}
+	hash := i.combinationHash()
+	if len(name) > maxNameLength-len(hash)-1 {
+		name = strings.TrimRight(name[:maxNameLength-len(hash)-1], "-_.")
+	}
+	return name + "-" + hash
+}
+
+// combinationHash returns a short hash of image name and its raw variables,
+// which differs even when sanitized names collide
+func (i *Image) combinationHash() string {
+	canonical, err := json.Marshal(map[string]any{"name": i.Name, "variables": i.Variables})
+	if err != nil {
+		canonical = fmt.Appendf(nil, "%s %v", i.Name, i.Variables)
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:])[:8]
+}
+
+// Disambiguate appends hash of the combination to UniqName and the generated
+// Dockerfile name, when sanitized variables of different combinations collide.
+func (i *Image) Disambiguate() {
+	i.disambiguated = true
+	if i.Dockerfile != i.DockerfileTemplate {
+		i.Dockerfile = i.generateDockerfilePath()
+	}
 }
 
 func (i *Image) SetFlags(flags *config.Flags) *Image {
@@ -290,6 +438,7 @@ func (i *Image) SetDockerfileTemplate(templateFile string) *Image {
 
 		if strings.HasSuffix(i.DockerfileTemplate, ".tpl") {
 			i.Dockerfile = i.generateDockerfilePath()
+			i.DockerignoreTemplate = findDockerignoreTemplate(i.DockerfileTemplate)
 		} else {
 			i.Dockerfile = i.DockerfileTemplate
 		}
@@ -302,8 +451,48 @@ func (i *Image) SetDockerfileTemplate(templateFile string) *Image {
 }
 
 func (i *Image) RemoveTemporaryDockerfile() {
+	if i.parent != nil {
+		return // shared with other platforms, removed after assembly
+	}
 	if i.Dockerfile != "" && i.Dockerfile != i.DockerfileTemplate {
 		util.RemoveFile(i.Dockerfile)
+		if i.DockerignoreTemplate != "" {
+			util.RemoveFile(i.Dockerignore())
+		}
+	}
+}
+
+// Dockerignore returns path of the rendered ignore file, following BuildKit's
+// convention of <Dockerfile>.dockerignore taking precedence over .dockerignore.
+func (i *Image) Dockerignore() string {
+	if i.DockerignoreTemplate == "" {
+		return ""
+	}
+	return i.Dockerfile + ".dockerignore"
+}
+
+// findDockerignoreTemplate looks for Dockerfile.tpl.dockerignore
+// or Dockerfile.dockerignore.tpl next to the Dockerfile template.
+func findDockerignoreTemplate(dockerfileTemplate string) string {
+	candidates := []string{
+		dockerfileTemplate + ".dockerignore",
+		strings.TrimSuffix(dockerfileTemplate, ".tpl") + ".dockerignore.tpl",
+	}
+	for _, candidate := range candidates {
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// RemoveStagingContext removes context created by StageContext, switching
+// back to the original one
+func (i *Image) RemoveStagingContext() {
+	if i.StagingDir != "" {
+		util.RemoveDir(i.StagingDir)
+		i.BuildContextDir = i.sourceContextDir
+		i.StagingDir = ""
 	}
 }
 
@@ -315,6 +504,15 @@ func (i *Image) Tags() []string {
 	return tags
 }
 
+// Aliases returns full names of tags generated by 'tag_aliases'
+func (i *Image) Aliases() []string {
+	aliases := []string{}
+	for _, tag := range i.aliases {
+		aliases = append(aliases, strings.ToLower(path.Join(i.Registry, i.Prefix, tag)))
+	}
+	return aliases
+}
+
 func (i *Image) OriginalTags() []string {
 	return i.tags
 }
@@ -332,6 +530,7 @@ func isReservedKey(key string) bool {
 	case
 		"args",
 		"env",
+		"git",
 		"image",
 		"labels",
 		"maintainer",
@@ -381,78 +580,14 @@ func generateCombinationString(configSet map[string]any) string {
 // to avoid tags like this
 // ERROR: invalid tag "test-case-7-alpine-3.21-crazy-map_key2_value2_-timezone-utc": invalid reference format
 func sanitizeForTag(input string) string {
-	// Replace any character that is not a letter, number, or safe symbol (-, _) with an underscore
-	// FIXME: This can actually result in collisions if someone uses a lot of symbols in variables
-	// 		  But I didn't face it yet, maybe it's not a problem at all
+	// Replace any character that is not a letter, number, or safe symbol (-, _) with a dash.
+	// Different values can end up the same, such collisions are detected by GeneratePlan
+	// and resolved with Disambiguate.
 	reg := regexp.MustCompile(`[^a-zA-Z0-9-_\.]+`)
 	return strings.Trim(reg.ReplaceAllString(input, "-"), "-")
 }
 
 func (i *Image) generateDockerfilePath() string {
 	dirname := filepath.Dir(i.DockerfileTemplate)
-	filename := strings.Trim(fmt.Sprintf("%s-%s.Dockerfile", i.Name, generateCombinationString(i.ConfigSet())), "-")
-	return filepath.Join(dirname, util.SanitizeForFileName(filename))
-}
-
-func (i *Image) ExtractFromDependencies() ([]string, error) {
-	if i.Dockerfile == "" {
-		return nil, fmt.Errorf("dockerfile path is not set")
-	}
-
-	file, err := os.Open(i.Dockerfile)
-	if err != nil {
-		return nil, err
-	}
-	defer func() {
-		if closeErr := file.Close(); closeErr != nil {
-			log.Error().Err(closeErr).Msg("Error closing file")
-		}
-	}()
-
-	var dependencies []string
-	args := make(map[string]string)
-
-	// Pre-fill with BuildArgs since they can override Dockerfile ARGs
-	for k, v := range i.BuildArgs {
-		args[k] = v
-	}
-
-	scanner := bufio.NewScanner(file)
-	fromRegex := regexp.MustCompile(`(?i)^\s*FROM\s+(?:--platform=[^\s]+\s+)?([^\s]+)`)
-	argRegex := regexp.MustCompile(`(?i)^\s*ARG\s+([^=\s]+)(?:=(.*))?`)
-
-	for scanner.Scan() {
-		line := scanner.Text()
-
-		if matches := argRegex.FindStringSubmatch(line); len(matches) > 1 {
-			name := matches[1]
-			// Only set if not already provided via BuildArgs
-			if _, exists := args[name]; !exists {
-				val := ""
-				if len(matches) > 2 {
-					val = matches[2]
-				}
-				args[name] = val
-			}
-			continue
-		}
-
-		if matches := fromRegex.FindStringSubmatch(line); len(matches) > 1 {
-			imageName := matches[1]
-
-			// Substitute ARGs
-			for k, v := range args {
-				imageName = strings.ReplaceAll(imageName, "${"+k+"}", v)
-				imageName = strings.ReplaceAll(imageName, "$"+k, v)
-			}
-
-			dependencies = append(dependencies, imageName)
-		}
-	}
-
-	if err := scanner.Err(); err != nil {
-		return nil, err
-	}
-
-	return dependencies, nil
+	return filepath.Join(dirname, util.SanitizeForFileName(i.combinationName()+".Dockerfile"))
 }
@@ -1,11 +1,14 @@
 package image_test
 
 import (
+	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/tgagor/template-dockerfiles/pkg/builder"
 	"github.com/tgagor/template-dockerfiles/pkg/config"
 	"github.com/tgagor/template-dockerfiles/pkg/image"
 	"github.com/tgagor/template-dockerfiles/pkg/parser"
@@ -164,7 +167,7 @@ func TestConfigSetGenerationCase6FailWithBadEngine(t *testing.T) {
 	for _, imageName := range cfg.ImageOrder {
 		combinations := parser.GenerateVariableCombinations(cfg.Images[imageName].Variables)
 		for _, set := range combinations {
-			img := image.From(imageName, cfg, set, &config.Flags{BuildFile: "../../tests/test-6.yaml", Build: true, Engine: "wrong"})
+			img := image.From(imageName, cfg, set, &config.Flags{BuildFile: "../../tests/test-6.yaml", Build: true, Engine: "wrong", Engines: builder.Engines})
 			require.ErrorContains(t, img.Validate(), "engine 'wrong' do not support multi-platform builds, use 'buildx' instead")
 		}
 	}
@@ -265,3 +268,337 @@ func TestConfigSetGenerationCase11(t *testing.T) {
 		}
 	}
 }
+
+func TestRenderAdditionalFiles(t *testing.T) {
+	t.Parallel()
+
+	contextDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "Dockerfile"), []byte("FROM alpine\n"), 0o644))
+	require.NoError(t, os.MkdirAll(filepath.Join(contextDir, "conf"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "conf", "jvm.options.tpl"), []byte("-Djava.version={{ .java }}\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "entrypoint.sh"), []byte("#!/bin/sh\n"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "app.oci.tar"), []byte("artifact"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, ".dockerignore"), []byte("*.tar\n"), 0o644))
+
+	cfg := &config.Config{
+		Images: map[string]config.ImageConfig{
+			"jdk": {
+				Dockerfile: "Dockerfile",
+				Context:    contextDir,
+				Files:      []string{"conf/jvm.options.tpl"},
+				Tags:       []string{"jdk:{{ .java }}"},
+			},
+		},
+	}
+	flags := &config.Flags{BuildFile: filepath.Join(contextDir, "build.yaml")}
+
+	img := image.From("jdk", cfg, map[string]any{"java": 17}, flags)
+	require.NoError(t, img.Validate())
+	require.NoError(t, img.Render())
+
+	// nothing is staged until the image is built
+	assert.Empty(t, img.StagingDir)
+	assert.Equal(t, contextDir, img.BuildContextDir)
+
+	require.NoError(t, img.StageContext())
+	defer img.RemoveStagingContext()
+	stagingDir := img.StagingDir
+
+	// build context is switched to the staging directory
+	assert.NotEqual(t, contextDir, img.BuildContextDir)
+	assert.Equal(t, stagingDir, img.BuildContextDir)
+
+	rendered, err := os.ReadFile(filepath.Join(stagingDir, "conf", "jvm.options"))
+	require.NoError(t, err)
+	assert.Equal(t, "-Djava.version=17\n", string(rendered))
+	assert.NoFileExists(t, filepath.Join(stagingDir, "conf", "jvm.options.tpl"))
+
+	// the rest of the context is copied as is, without ignored files
+	info, err := os.Stat(filepath.Join(stagingDir, "entrypoint.sh"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o755), info.Mode().Perm())
+	assert.NoFileExists(t, filepath.Join(stagingDir, "app.oci.tar"))
+
+	// source context stays untouched
+	assert.NoFileExists(t, filepath.Join(contextDir, "conf", "jvm.options"))
+
+	img.RemoveStagingContext()
+	assert.NoDirExists(t, stagingDir)
+	assert.Equal(t, contextDir, img.BuildContextDir)
+}
+
+func TestValidateAdditionalFiles(t *testing.T) {
+	t.Parallel()
+
+	for _, files := range [][]string{{"jvm.options"}, {"../outside.tpl"}} {
+		cfg := &config.Config{
+			Images: map[string]config.ImageConfig{
+				"jdk": {Dockerfile: "Dockerfile", Files: files, Tags: []string{"jdk"}},
+			},
+		}
+		img := image.From("jdk", cfg, map[string]any{}, &config.Flags{BuildFile: "build.yaml"})
+		assert.Error(t, img.Validate())
+	}
+}
+
+func TestRenderDockerignore(t *testing.T) {
+	t.Parallel()
+
+	for _, ignoreName := range []string{"Dockerfile.tpl.dockerignore", "Dockerfile.dockerignore.tpl"} {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "Dockerfile.tpl"), []byte("FROM alpine:{{ .alpine }}\n"), 0o644))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, ignoreName), []byte("*\n!alpine-{{ .alpine }}/\n"), 0o644))
+
+		cfg := &config.Config{
+			Images: map[string]config.ImageConfig{
+				"base": {Dockerfile: "Dockerfile.tpl", Tags: []string{"base:{{ .alpine }}"}},
+			},
+		}
+		flags := &config.Flags{BuildFile: filepath.Join(dir, "build.yaml")}
+
+		img := image.From("base", cfg, map[string]any{"alpine": "3.20"}, flags)
+		require.NoError(t, img.Validate())
+		require.NoError(t, img.Render())
+
+		// BuildKit picks <Dockerfile>.dockerignore up automatically
+		assert.Equal(t, img.Dockerfile+".dockerignore", img.Dockerignore())
+		rendered, err := os.ReadFile(img.Dockerignore())
+		require.NoError(t, err)
+		assert.Equal(t, "*\n!alpine-3.20/\n", string(rendered))
+
+		img.RemoveTemporaryDockerfile()
+		assert.NoFileExists(t, img.Dockerfile)
+		assert.NoFileExists(t, img.Dockerignore())
+	}
+}
+
+func TestSourceDateEpoch(t *testing.T) {
+	t.Parallel()
+
+	cfg := loadConfig("test-1.yaml")
+	flags := &config.Flags{BuildFile: "../../tests/test-1.yaml", SourceDateEpoch: "1700000000"}
+
+	img := image.From("test-case-1", cfg, map[string]any{"alpine": "3.20"}, flags)
+	assert.Equal(t, "2023-11-14T22:13:20Z", img.Labels["org.opencontainers.image.created"])
+	assert.Equal(t, "1700000000", img.BuildArgs["SOURCE_DATE_EPOCH"])
+
+	epoch, err := image.SourceDateEpoch("1700000000", ".")
+	require.NoError(t, err)
+	assert.Equal(t, "1700000000", epoch)
+
+	// time of HEAD commit of this repository
+	epoch, err = image.SourceDateEpoch("git", ".")
+	require.NoError(t, err)
+	assert.Regexp(t, "^[0-9]+$", epoch)
+
+	_, err = image.SourceDateEpoch("yesterday", ".")
+	assert.Error(t, err)
+}
+
+func TestRenderInvalidTags(t *testing.T) {
+	t.Parallel()
+
+	contextDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "Dockerfile"), []byte("FROM alpine\n"), 0o644))
+
+	cfg := &config.Config{
+		Registry: "repo.local",
+		Images: map[string]config.ImageConfig{
+			"jdk": {
+				Dockerfile: "Dockerfile",
+				Context:    contextDir,
+				Tags: []string{
+					"jdk:{{ .java }}",
+					"jdk:{{ .java }}+{{ .vendor }}",
+					"jdk_:{{ .java }}",
+					"jdk:" + strings.Repeat("x", 129),
+				},
+			},
+		},
+	}
+	flags := &config.Flags{BuildFile: filepath.Join(contextDir, "build.yaml")}
+
+	img := image.From("jdk", cfg, map[string]any{"java": 17, "vendor": "temurin"}, flags)
+	require.NoError(t, img.Validate())
+	err := img.Render()
+	require.Error(t, err)
+
+	var tagErr *image.TagError
+	require.ErrorAs(t, err, &tagErr)
+	assert.Equal(t, "jdk", tagErr.Image)
+	assert.Equal(t, "java=17, vendor=temurin", tagErr.Combination)
+	assert.Equal(t, "jdk:{{ .java }}+{{ .vendor }}", tagErr.Template)
+	assert.Equal(t, "repo.local/jdk:17+temurin", tagErr.Tag)
+
+	assert.Contains(t, err.Error(), `image jdk (java=17, vendor=temurin), field tags, template "jdk:{{ .java }}+{{ .vendor }}": invalid tag "repo.local/jdk:17+temurin"`)
+	assert.Contains(t, err.Error(), `template "jdk_:{{ .java }}"`)
+	assert.Contains(t, err.Error(), "repo.local/jdk:xxx")
+	assert.NotContains(t, err.Error(), `template "jdk:{{ .java }}"`)
+	assert.Len(t, err.(interface{ Unwrap() []error }).Unwrap(), 3)
+}
+
+func TestUniqNameLengthAndDisambiguate(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{
+		Images: map[string]config.ImageConfig{
+			"app": {Dockerfile: "Dockerfile.tpl", Tags: []string{"app"}},
+		},
+	}
+	flags := &config.Flags{BuildFile: "../../tests/build.yaml"}
+
+	img := image.From("app", cfg, map[string]any{"alpine": "3.20"}, flags)
+	assert.Equal(t, "app-alpine-3.20", img.UniqName())
+	assert.Equal(t, "../../tests/app-alpine-3.20.Dockerfile", img.Dockerfile)
+
+	img.Disambiguate()
+	assert.Regexp(t, `^app-alpine-3\.20-[0-9a-f]{8}$`, img.UniqName())
+	assert.Equal(t, "../../tests/"+img.UniqName()+".Dockerfile", img.Dockerfile)
+
+	// hash depends on raw values, so sanitized collisions are resolved
+	other := image.From("app", cfg, map[string]any{"alpine": "3/20"}, flags)
+	other.Disambiguate()
+	assert.NotEqual(t, img.UniqName(), other.UniqName())
+
+	// many variables are capped
+	long := image.From("app", cfg, map[string]any{
+		"description": strings.Repeat("very-long-value-", 10),
+		"java":        21,
+	}, flags)
+	assert.Len(t, long.UniqName(), 100)
+	assert.Regexp(t, `^app-description-very-long-value-.*-[0-9a-f]{8}$`, long.UniqName())
+	assert.NotEqual(t, long.UniqName(), image.From("app", cfg, map[string]any{
+		"description": strings.Repeat("very-long-value-", 10),
+		"java":        17,
+	}, flags).UniqName())
+}
+
+func TestValidateEngineCapabilities(t *testing.T) {
+	t.Parallel()
+
+	engines := []config.Engine{
+		{Name: "test-limited"},
+		{Name: "test-capable", MultiPlatform: true, Cache: true, Secrets: true},
+	}
+	cfg := &config.Config{
+		GlobalPlatforms: []string{"linux/amd64", "linux/arm64"},
+		Images: map[string]config.ImageConfig{
+			"app": {Dockerfile: "Dockerfile", Tags: []string{"app"}},
+		},
+	}
+	validate := func(flags config.Flags) error {
+		flags.BuildFile = "../../tests/build.yaml"
+		flags.Build = true
+		flags.Engines = engines
+		return image.From("app", cfg, map[string]any{}, &flags).Validate()
+	}
+
+	assert.NoError(t, validate(config.Flags{Engine: "test-capable", CacheFrom: []string{"type=gha"}, Secrets: []string{"id=token"}}))
+
+	err := validate(config.Flags{Engine: "test-limited"})
+	assert.ErrorContains(t, err, "engine 'test-limited' do not support multi-platform builds, use 'test-capable' instead")
+
+	cfg.GlobalPlatforms = nil
+	assert.NoError(t, validate(config.Flags{Engine: "test-limited"}))
+	assert.ErrorContains(t, validate(config.Flags{Engine: "test-limited", CacheTo: []string{"type=inline"}}), "engine 'test-limited' do not support build cache import and export")
+	assert.ErrorContains(t, validate(config.Flags{Engine: "test-limited", Secrets: []string{"id=token"}}), "engine 'test-limited' do not support build secrets")
+
+	// without building, engine doesn't matter
+	assert.NoError(t, image.From("app", cfg, map[string]any{}, &config.Flags{BuildFile: "../../tests/build.yaml", Engine: "test-limited", Secrets: []string{"id=token"}}).Validate())
+}
+
+func TestValidateBuildKitFeatures(t *testing.T) {
+	t.Parallel()
+
+	engines := []config.Engine{
+		{Name: "test-buildkit", BuildKit: true},
+		{Name: "test-classic"},
+	}
+	validate := func(engine string, dockerfile string) error {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "Dockerfile"), []byte(dockerfile), 0o644))
+		cfg := &config.Config{
+			Images: map[string]config.ImageConfig{
+				"app": {Dockerfile: "Dockerfile", Tags: []string{"app"}},
+			},
+		}
+		flags := &config.Flags{BuildFile: filepath.Join(dir, "build.yaml"), Build: true, Engine: engine, Engines: engines}
+		return image.From("app", cfg, map[string]any{}, flags).Validate()
+	}
+
+	assert.NoError(t, validate("test-classic", "FROM alpine\nCOPY --from=repo.local/base:1 /app /app\n"))
+	assert.NoError(t, validate("test-buildkit", "FROM alpine\nRUN --mount=from=repo.local/base:1,target=/base ls /base\n"))
+
+	err := validate("test-classic", "FROM alpine\nRUN --mount=from=repo.local/base:1,target=/base ls /base\n")
+	assert.ErrorContains(t, err, "engine 'test-classic' do not support RUN --mount (line 2), which needs BuildKit, use 'test-buildkit' instead")
+	assert.ErrorContains(t, validate("test-classic", "FROM alpine\nCOPY --link app /app\n"), "COPY --link (line 2)")
+	assert.ErrorContains(t, validate("test-classic", "FROM alpine\nRUN <<EOF\necho hi\nEOF\n"), "heredocs in RUN (line 2)")
+	assert.ErrorContains(t, validate("test-classic", "# syntax=docker/dockerfile:1\nFROM alpine\n"), "Dockerfile frontend docker/dockerfile:1")
+
+	// ignore file per Dockerfile
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "Dockerfile.tpl"), []byte("FROM alpine\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "Dockerfile.tpl.dockerignore"), []byte("*.log\n"), 0o644))
+	cfg := &config.Config{
+		Images: map[string]config.ImageConfig{
+			"app": {Dockerfile: "Dockerfile.tpl", Tags: []string{"app"}},
+		},
+	}
+	flags := &config.Flags{BuildFile: filepath.Join(dir, "build.yaml"), Build: true, Engine: "test-classic", Engines: engines}
+	assert.ErrorContains(t, image.From("app", cfg, map[string]any{}, flags).Validate(), "ignore file per Dockerfile")
+}
+
+func TestParseOutput(t *testing.T) {
+	t.Parallel()
+
+	output, err := image.ParseOutput("oci:dist/images")
+	assert.NoError(t, err)
+	assert.Equal(t, image.Output{Format: image.OutputOCI, Dir: "dist/images"}, output)
+
+	_, err = image.ParseOutput("dist")
+	assert.ErrorContains(t, err, "expected oci:<dir> or tar:<dir>")
+	_, err = image.ParseOutput("tar:")
+	assert.ErrorContains(t, err, "expected oci:<dir> or tar:<dir>")
+	_, err = image.ParseOutput("zip:dist")
+	assert.ErrorContains(t, err, "unsupported --output type 'zip'")
+}
+
+func TestValidateOutput(t *testing.T) {
+	t.Parallel()
+
+	engines := []config.Engine{
+		{Name: "test-exporter", MultiPlatform: true, Export: true},
+		{Name: "test-multiplatform", MultiPlatform: true},
+		{Name: "docker"},
+	}
+	cfg := &config.Config{
+		Images: map[string]config.ImageConfig{
+			"app": {Dockerfile: "Dockerfile", Tags: []string{"app"}, Variables: map[string]any{"version": "1.0"}},
+		},
+	}
+	from := func(flags config.Flags) *image.Image {
+		flags.BuildFile = "../../tests/build.yaml"
+		flags.Build = true
+		flags.Engines = engines
+		return image.From("app", cfg, map[string]any{"version": "1.0"}, &flags)
+	}
+
+	img := from(config.Flags{Engine: "test-exporter", Output: "tar:dist"})
+	assert.NoError(t, img.Validate())
+	assert.Equal(t, filepath.Join("dist", "app-version-1.0.tar"), img.Output().Path(img))
+
+	img = from(config.Flags{Engine: "test-exporter", Output: "oci:dist"})
+	assert.Equal(t, filepath.Join("dist", "app-version-1.0"), img.Output().Path(img))
+	assert.Nil(t, from(config.Flags{Engine: "test-exporter"}).Output())
+
+	assert.ErrorContains(t, from(config.Flags{Engine: "docker", Output: "oci:dist"}).Validate(), "engine 'docker' do not support exporting images with --output")
+	assert.ErrorContains(t, from(config.Flags{Engine: "test-exporter", Output: "dist"}).Validate(), "invalid --output 'dist'")
+
+	cfg.GlobalPlatforms = []string{"linux/amd64", "linux/arm64"}
+	assert.ErrorContains(t, from(config.Flags{Engine: "test-exporter", Output: "tar:dist"}).Validate(), "can't be exported as docker-archive, use --output oci:dist instead")
+	assert.NoError(t, from(config.Flags{Engine: "test-exporter", Output: "oci:dist"}).Validate())
+
+	// parts of split images are exported, until they're assembled
+	assert.NoError(t, from(config.Flags{Engine: "test-exporter", SplitPlatforms: true}).Validate())
+	assert.ErrorContains(t, from(config.Flags{Engine: "test-multiplatform", SplitPlatforms: true}).Validate(), "engine 'test-multiplatform' do not support building platforms separately")
+}
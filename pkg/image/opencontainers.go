@@ -2,16 +2,15 @@ package image
 
 import (
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/rs/zerolog/log"
-
-	git "github.com/go-git/go-git/v5"
 )
 
 // Follow:
 // https://github.com/opencontainers/image-spec/blob/main/annotations.md
-func collectOCILabels(cfg map[string]any) map[string]string {
+func collectOCILabels(cfg map[string]any, created time.Time, gitInfo *GitInfo) map[string]string {
 	labels := map[string]string{}
 
 	if cfg["maintainer"] != "" {
@@ -23,21 +22,17 @@ func collectOCILabels(cfg map[string]any) map[string]string {
 		labels["org.opencontainers.image.version"] = cfg["tag"].(string)
 	}
 
-	timestamp := time.Now().Format(time.RFC3339)
-	labels["org.opencontainers.image.created"] = string(timestamp)
+	labels["org.opencontainers.image.created"] = created.Format(time.RFC3339)
 
-	originUrl, hexsha, branch, err := readGitRepo(".")
-	if err != nil {
-		log.Warn().Err(err).Msg("Not being able to read git repo metadata, or not a git repo. Skipping.")
-	} else {
-		if originUrl != "" {
-			labels["org.opencontainers.image.source"] = originUrl
+	if gitInfo != nil {
+		if gitInfo.Origin != "" {
+			labels["org.opencontainers.image.source"] = gitInfo.Origin
 		}
-		if hexsha != "" {
-			labels["org.opencontainers.image.revision"] = hexsha
+		if gitInfo.Revision != "" {
+			labels["org.opencontainers.image.revision"] = gitInfo.Revision
 		}
-		if branch != "" {
-			labels["org.opencontainers.image.branch"] = branch
+		if gitInfo.Branch != "" {
+			labels["org.opencontainers.image.branch"] = gitInfo.Branch
 		}
 	}
 
@@ -45,46 +40,34 @@ func collectOCILabels(cfg map[string]any) map[string]string {
 	return labels
 }
 
-func readGitRepo(path string) (originURL string, commitHex string, branchName string, err error) {
-	// Open the local git repository
-	repo, err := git.PlainOpen(path)
-	if err != nil {
-		if err == git.ErrRepositoryNotExists {
-			// Return nothing if it's not a Git repository
-			return "", "", "", nil
+// SourceDateEpoch resolves value of --source-date-epoch: "git" stands for
+// the time of the HEAD commit of repository containing path, otherwise
+// it has to be a Unix timestamp.
+func SourceDateEpoch(value string, path string) (string, error) {
+	if value != "git" {
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return "", fmt.Errorf("SOURCE_DATE_EPOCH should be a Unix timestamp or 'git', got '%s'", value)
 		}
-		return "", "", "", fmt.Errorf("failed to open repository: %w", err)
+		return value, nil
 	}
 
-	// Get the repository's remotes and find the origin remote
-	remotes, err := repo.Remotes()
+	gitInfo, err := ReadGit(path)
 	if err != nil {
-		return "", "", "", fmt.Errorf("failed to list remotes: %w", err)
-	}
-
-	for _, remote := range remotes {
-		if remote.Config().Name == "origin" {
-			if len(remote.Config().URLs) > 0 {
-				originURL = remote.Config().URLs[0]
-			}
-			break
-		}
+		return "", err
 	}
-
-	// Get the HEAD reference (current branch or commit)
-	head, err := repo.Head()
-	if err != nil {
-		return originURL, "", "", fmt.Errorf("failed to get HEAD: %w", err)
+	if gitInfo == nil {
+		return "", fmt.Errorf("%s is not in a git repository", path)
 	}
+	return gitInfo.commitTimestamp(), nil
+}
 
-	commitHex = head.Hash().String()
-
-	// Determine the current branch name
-	if head.Name().IsBranch() {
-		branchName = head.Name().Short()
-	} else {
-		branchName = "" // Detached HEAD state
+// createdTime returns timestamp for org.opencontainers.image.created label,
+// fixed with SOURCE_DATE_EPOCH for reproducible builds.
+func createdTime(sourceDateEpoch string) time.Time {
+	if sourceDateEpoch != "" {
+		if epoch, err := strconv.ParseInt(sourceDateEpoch, 10, 64); err == nil {
+			return time.Unix(epoch, 0).UTC()
+		}
 	}
-
-	return originURL, commitHex, branchName, nil
+	return time.Now()
 }
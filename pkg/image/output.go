@@ -0,0 +1,71 @@
+package image
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/tgagor/template-dockerfiles/pkg/util"
+)
+
+// Formats of --output, used instead of a daemon to carry images to another network
+const (
+	OutputOCI = "oci" // OCI image layout directory
+	OutputTar = "tar" // docker-archive tarball, loadable with 'docker load'
+)
+
+// Output describes where images are exported, parsed from --output like "oci:dist"
+type Output struct {
+	Format string
+	Dir    string
+}
+
+// ParseOutput parses --output value in format <type>:<dir>
+func ParseOutput(spec string) (Output, error) {
+	format, dir, found := strings.Cut(spec, ":")
+	if !found || dir == "" {
+		return Output{}, fmt.Errorf("invalid --output '%s', expected %s:<dir> or %s:<dir>", spec, OutputOCI, OutputTar)
+	}
+	switch format {
+	case OutputOCI, OutputTar:
+		return Output{Format: format, Dir: dir}, nil
+	}
+	return Output{}, fmt.Errorf("unsupported --output type '%s', use %s or %s", format, OutputOCI, OutputTar)
+}
+
+// Path is where the image is exported, named after its UniqName
+func (o Output) Path(img *Image) string {
+	name := util.SanitizeForFileName(img.UniqName())
+	if o.Format == OutputTar {
+		name += ".tar"
+	}
+	return filepath.Join(o.Dir, name)
+}
+
+// Output returns export destination selected with --output, or nil when
+// images should go to the daemon or registry
+func (i *Image) Output() *Output {
+	if i.Flags == nil || i.Flags.Output == "" {
+		return nil
+	}
+	output, err := ParseOutput(i.Flags.Output)
+	if err != nil {
+		return nil // reported by Validate
+	}
+	return &output
+}
+
+// validateOutput checks if the image can be exported in requested format
+func (i *Image) validateOutput() error {
+	if i.Flags.Output == "" {
+		return nil
+	}
+	output, err := ParseOutput(i.Flags.Output)
+	if err != nil {
+		return err
+	}
+	if output.Format == OutputTar && len(i.Platforms) > 1 {
+		return fmt.Errorf("multi-platform image %s can't be exported as docker-archive, use --output %s:%s instead", i.Name, OutputOCI, output.Dir)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package image
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/tgagor/template-dockerfiles/pkg/util"
+)
+
+// ForPlatform copies the image to build only one of its platforms, as a part
+// of an image index assembled later (--split-platforms). Part shares rendered
+// Dockerfile, build context and tags with the image.
+func (i *Image) ForPlatform(platform string) *Image {
+	part := *i
+	part.Platforms = []string{platform}
+	part.parent = i
+	return &part
+}
+
+// Parent returns image split into platforms, or nil if image isn't a part of one
+func (i *Image) Parent() *Image {
+	return i.parent
+}
+
+// PlatformLayout is a path of OCI layout where a part built for single
+// platform is kept until the image index is assembled
+func (i *Image) PlatformLayout() string {
+	name := i.UniqName() + "-" + strings.Join(i.Platforms, "-")
+	return filepath.Join(filepath.Dir(i.DockerfileTemplate), util.SanitizeForFileName(name)+".oci")
+}
+
+// SplitPlatforms tells if platforms of the image are built separately
+func (i *Image) SplitPlatforms() bool {
+	return i.Flags != nil && i.Flags.SplitPlatforms && i.parent == nil && len(i.Platforms) > 1
+}
@@ -0,0 +1,71 @@
+package image
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/distribution/reference"
+)
+
+// TagError describes a rendered tag, which is not a valid image reference
+type TagError struct {
+	Image       string
+	Combination string
+	Template    string
+	Tag         string
+	Err         error
+}
+
+func (e *TagError) Error() string {
+	image := e.Image
+	if e.Combination != "" {
+		image += " (" + e.Combination + ")"
+	}
+	return fmt.Sprintf("image %s, field tags, template %q: invalid tag %q: %s", image, e.Template, e.Tag, e.Err)
+}
+
+func (e *TagError) Unwrap() error {
+	return e.Err
+}
+
+// validateTags checks full names of rendered tags against the reference
+// grammar used by registries: lowercase repository components, tags up to
+// 128 characters of letters, digits, '_', '.' and '-'. Templates are
+// index aligned with tags.
+func (i *Image) validateTags(templates []string) []error {
+	var errs []error
+	for n, tag := range i.Tags() {
+		if err := validateReference(tag); err != nil {
+			errs = append(errs, &TagError{
+				Image:       i.Name,
+				Combination: combinationDescription(i.Variables),
+				Template:    templates[n],
+				Tag:         tag,
+				Err:         err,
+			})
+		}
+	}
+	return errs
+}
+
+func validateReference(tag string) error {
+	named, err := reference.ParseNormalizedNamed(tag)
+	if err != nil {
+		return err
+	}
+	if _, ok := named.(reference.Digested); ok {
+		return fmt.Errorf("digest is not allowed in tags")
+	}
+	return nil
+}
+
+// combinationDescription formats variables like "alpine=3.20, java=21"
+func combinationDescription(variables map[string]any) string {
+	var parts []string
+	for k, v := range variables {
+		parts = append(parts, fmt.Sprintf("%s=%v", k, v))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
@@ -2,8 +2,12 @@ package image
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"text/template"
 
@@ -11,20 +15,99 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+// name used for inline templates, it's part of text/template error messages
+const inlineTemplateName = "inline"
+
+// TemplateError describes a template that failed to parse or execute.
+// Image and Field are filled in by the caller that knows the context.
+type TemplateError struct {
+	Image    string
+	Field    string
+	Template string
+	Line     int
+	Column   int
+	Err      error
+}
+
+func (e *TemplateError) Error() string {
+	var parts []string
+	if e.Image != "" {
+		parts = append(parts, fmt.Sprintf("image %s", e.Image))
+	}
+	if e.Field != "" {
+		parts = append(parts, fmt.Sprintf("field %s", e.Field))
+	}
+	position := fmt.Sprintf("template %q", e.Template)
+	if e.Line > 0 {
+		position += fmt.Sprintf(" line %d", e.Line)
+		if e.Column > 0 {
+			position += fmt.Sprintf(" column %d", e.Column)
+		}
+	}
+	parts = append(parts, position)
+	return strings.Join(parts, ", ") + ": " + e.Err.Error()
+}
+
+func (e *TemplateError) Unwrap() error {
+	return e.Err
+}
+
+// newTemplateError converts text/template errors, which look like:
+//
+//	template: NAME:LINE: message
+//	template: NAME:LINE:COL: executing "NAME" at <.x>: message
+//
+// into a TemplateError with position extracted.
+func newTemplateError(name string, source string, err error) *TemplateError {
+	tplErr := &TemplateError{Template: source, Err: err}
+
+	re := regexp.MustCompile(`^template: ` + regexp.QuoteMeta(name) + `:(\d+)(?::(\d+))?: (?s)(.*)$`)
+	if matches := re.FindStringSubmatch(err.Error()); matches != nil {
+		tplErr.Line, _ = strconv.Atoi(matches[1])
+		if matches[2] != "" {
+			tplErr.Column, _ = strconv.Atoi(matches[2])
+		}
+		tplErr.Err = errors.New(matches[3])
+	}
+	return tplErr
+}
+
+// withContext sets image and field on every TemplateError found in err
+func withContext(err error, image string, field string) error {
+	var joined interface{ Unwrap() []error }
+	if errors.As(err, &joined) {
+		for _, e := range joined.Unwrap() {
+			_ = withContext(e, image, field)
+		}
+		return err
+	}
+	var tplErr *TemplateError
+	if errors.As(err, &tplErr) {
+		tplErr.Image = image
+		tplErr.Field = field
+	}
+	return err
+}
+
 func TemplateString(pattern string, args map[string]any) (string, error) {
 	var output bytes.Buffer
-	t := template.Must(template.New(pattern).Funcs(sprig.TxtFuncMap()).Parse(pattern))
+	t, err := template.New(inlineTemplateName).Funcs(sprig.TxtFuncMap()).Parse(pattern)
+	if err != nil {
+		return "", newTemplateError(inlineTemplateName, pattern, err)
+	}
 	if err := t.Execute(&output, args); err != nil {
-		return "", err
+		return "", newTemplateError(inlineTemplateName, pattern, err)
 	}
 
 	return output.String(), nil
 }
 
 func TemplateFile(templateFile string, destinationFile string, args map[string]any) error {
-	t := template.Must(
-		template.New(filepath.Base(templateFile)).Funcs(sprig.TxtFuncMap()).ParseFiles(templateFile),
-	)
+	name := filepath.Base(templateFile)
+	t, err := template.New(name).Funcs(sprig.TxtFuncMap()).ParseFiles(templateFile)
+	if err != nil {
+		return newTemplateError(name, templateFile, err)
+	}
 
 	f, err := os.Create(destinationFile)
 	if err != nil {
@@ -40,22 +123,41 @@ func TemplateFile(templateFile string, destinationFile string, args map[string]a
 	// Render templates using variables
 	if err := t.Execute(f, args); err != nil {
 		log.Error().Err(err).Str("file", templateFile).Msg("Failed to template")
-		return err
+		return newTemplateError(name, templateFile, err)
 	}
 
 	return nil
 }
 
+// RenderFile templates file into memory
+func RenderFile(templateFile string, args map[string]any) ([]byte, error) {
+	name := filepath.Base(templateFile)
+	t, err := template.New(name).Funcs(sprig.TxtFuncMap()).ParseFiles(templateFile)
+	if err != nil {
+		return nil, newTemplateError(name, templateFile, err)
+	}
+	var output bytes.Buffer
+	if err := t.Execute(&output, args); err != nil {
+		return nil, newTemplateError(name, templateFile, err)
+	}
+	return output.Bytes(), nil
+}
+
 func TemplateList(source []string, configSet map[string]any) ([]string, error) {
 	var templated []string
+	var errs []error
 
 	for _, label := range source {
 		templatedString, err := TemplateString(label, configSet)
 		if err != nil {
-			return nil, err
+			errs = append(errs, err)
+			continue
 		}
 		templated = append(templated, strings.Trim(templatedString, " \n"))
 	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
 
 	if len(templated) > 0 {
 		log.Trace().Interface("source", source).Interface("templated", templated).Msg("Templating list")
@@ -66,20 +168,26 @@ func TemplateList(source []string, configSet map[string]any) ([]string, error) {
 
 func TemplateMap(source map[string]string, configSet map[string]any) (map[string]string, error) {
 	templated := map[string]string{}
+	var errs []error
 
 	for label, value := range source {
 		templatedLabel, err := TemplateString(label, configSet)
 		if err != nil {
-			return nil, err
+			errs = append(errs, err)
+			continue
 		}
 		templatedValue, err := TemplateString(value, configSet)
 		if err != nil {
-			return nil, err
+			errs = append(errs, err)
+			continue
 		}
 		templatedLabel = strings.Trim(templatedLabel, " \n")
 		templatedValue = strings.Trim(templatedValue, " \n")
 		templated[templatedLabel] = templatedValue
 	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
 
 	if len(templated) > 0 {
 		log.Trace().Interface("source", source).Interface("templated", templated).Msg("Templating map")
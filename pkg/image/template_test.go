@@ -5,6 +5,7 @@ import (
 
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/tgagor/template-dockerfiles/pkg/image"
 )
 
@@ -99,3 +100,34 @@ func TestTemplateMap(t *testing.T) {
 	assert.Equal(t, expected, result)
 	assert.Nil(t, err)
 }
+
+func TestTemplateStringSyntaxError(t *testing.T) {
+	t.Parallel()
+
+	result, err := image.TemplateString("alpine:{{ .alpine | frist }}", map[string]any{"alpine": "3.20"})
+	assert.Empty(t, result)
+	require.Error(t, err)
+
+	var tplErr *image.TemplateError
+	require.ErrorAs(t, err, &tplErr)
+	assert.Equal(t, "alpine:{{ .alpine | frist }}", tplErr.Template)
+	assert.Equal(t, 1, tplErr.Line)
+	assert.Contains(t, tplErr.Error(), `function "frist" not defined`)
+}
+
+func TestTemplateListCollectsErrors(t *testing.T) {
+	t.Parallel()
+
+	input := []string{
+		"test:{{ .alpine | frist }}",
+		"test:{{ .alpine }}",
+		"test:{{ if .alpine }}",
+	}
+
+	result, err := image.TemplateList(input, map[string]any{"alpine": "3.20"})
+	assert.Nil(t, result)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `template "test:{{ .alpine | frist }}"`)
+	assert.Contains(t, err.Error(), `template "test:{{ if .alpine }}"`)
+	assert.NotContains(t, err.Error(), `template "test:{{ .alpine }}"`)
+}
@@ -0,0 +1,80 @@
+package parser
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/tgagor/template-dockerfiles/pkg/config"
+)
+
+// TagConflict is a tag produced by more than one combination
+type TagConflict struct {
+	Tag        string
+	Candidates []string // node IDs in order of configuration
+	Winner     string   // node ID keeping the tag, empty when planning failed
+}
+
+// resolveTagConflicts keeps every tag on a single node, selected by policy,
+// and removes it from the others
+func (p *Plan) resolveTagConflicts(nodes []*Node, policy string) error {
+	owners := make(map[string][]string) // tag -> node IDs
+	var order []string
+	for _, node := range nodes {
+		for _, tag := range node.Image.Tags() {
+			if len(owners[tag]) == 0 {
+				order = append(order, tag)
+			}
+			if !slices.Contains(owners[tag], node.ID) {
+				owners[tag] = append(owners[tag], node.ID)
+			}
+		}
+	}
+
+	p.TagConflicts = nil
+	winners := make(map[string]string) // tag -> node ID
+	for _, tag := range order {
+		candidates := owners[tag]
+		winner := candidates[len(candidates)-1]
+		if policy == config.TagConflictsFirstWins {
+			winner = candidates[0]
+		}
+		winners[tag] = winner
+		if len(candidates) > 1 {
+			p.TagConflicts = append(p.TagConflicts, TagConflict{Tag: tag, Candidates: candidates, Winner: winner})
+		}
+	}
+
+	if policy == config.TagConflictsError && len(p.TagConflicts) > 0 {
+		var lines []string
+		for _, conflict := range p.TagConflicts {
+			lines = append(lines, fmt.Sprintf("%s produced by %s", conflict.Tag, strings.Join(conflict.Candidates, ", ")))
+		}
+		return fmt.Errorf("tags produced by more than one combination:\n  %s", strings.Join(lines, "\n  "))
+	}
+
+	level := zerolog.InfoLevel
+	if policy == config.TagConflictsWarn {
+		level = zerolog.WarnLevel
+	}
+	for _, conflict := range p.TagConflicts {
+		log.WithLevel(level).Str("tag", conflict.Tag).Strs("combinations", conflict.Candidates).Str("winner", conflict.Winner).Msg("Tag produced by more than one combination")
+	}
+
+	// prune tags owned by other nodes
+	for _, node := range nodes {
+		var keptOriginalTags []string
+		originalTags := node.Image.OriginalTags()
+		for i, tag := range node.Image.Tags() {
+			if winners[tag] == node.ID {
+				keptOriginalTags = append(keptOriginalTags, originalTags[i])
+			} else {
+				log.Debug().Str("tag", tag).Str("image", node.ID).Str("winner", winners[tag]).Msg("Tag deduplicated")
+			}
+		}
+		node.Image.SetOriginalTags(keptOriginalTags)
+	}
+	return nil
+}
@@ -2,9 +2,11 @@ package parser
 
 import (
 	"maps"
+	"slices"
 )
 
-// generates all combinations of variables
+// generates all combinations of variables, in a stable order: variables
+// sorted by name, values in order of configuration
 func GenerateVariableCombinations(variables map[string]any) []map[string]any {
 	var combinations []map[string]any
 
@@ -31,8 +33,8 @@ func GenerateVariableCombinations(variables map[string]any) []map[string]any {
 			current[key] = v
 			generate(current, remaining, keys[1:])
 		case map[string]any:
-			for subKey, subValue := range v {
-				current[key] = map[string]any{subKey: subValue}
+			for _, subKey := range slices.Sorted(maps.Keys(v)) {
+				current[key] = map[string]any{subKey: v[subKey]}
 				generate(current, remaining, keys[1:])
 			}
 		default:
@@ -46,11 +48,7 @@ func GenerateVariableCombinations(variables map[string]any) []map[string]any {
 }
 
 func getKeys(m map[string]any) []string {
-	keys := make([]string, 0, len(m))
-	for k := range m {
-		keys = append(keys, k)
-	}
-	return keys
+	return slices.Sorted(maps.Keys(m))
 }
 
 func isExcluded(configSet map[string]any, excludedSets []map[string]any) bool {
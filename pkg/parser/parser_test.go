@@ -1,10 +1,14 @@
 package parser_test
 
 import (
+	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/tgagor/template-dockerfiles/pkg/config"
 	"github.com/tgagor/template-dockerfiles/pkg/parser"
 )
@@ -226,3 +230,273 @@ func TestCombinationsCase8(t *testing.T) {
 		assert.NotContains(t, combinations, exclude)
 	}
 }
+
+func TestGeneratePlanCollectsTemplateErrors(t *testing.T) {
+	t.Parallel()
+
+	cfg := loadConfig("test-12.yaml")
+	flags := &config.Flags{BuildFile: "../../tests/test-12.yaml"}
+
+	plan, err := parser.GeneratePlan(cfg, flags)
+	assert.Nil(t, plan)
+	require.Error(t, err)
+
+	// both broken templates are reported, once each, not only the first one
+	assert.Equal(t, 1, strings.Count(err.Error(), `field labels, template "{{ .alpine | frist }}"`))
+	assert.Equal(t, 1, strings.Count(err.Error(), `field tags, template "test-case-12:{{ if .alpine }}"`))
+	assert.Contains(t, err.Error(), "image test-case-12")
+}
+
+func TestGeneratePlanExplicitDependencies(t *testing.T) {
+	t.Parallel()
+
+	cfg := loadConfig("test-13.yaml")
+	flags := &config.Flags{BuildFile: "../../tests/test-13.yaml"}
+
+	plan, err := parser.GeneratePlan(cfg, flags)
+	require.NoError(t, err)
+	require.Len(t, plan.Nodes, 7)
+
+	assert.Equal(t, []string{"base-alpine-3.20"}, plan.Nodes["jdk-alpine-3.20-java-17"].DependsOn)
+	assert.Equal(t, []string{"base-alpine-3.21"}, plan.Nodes["jdk-alpine-3.21-java-21"].DependsOn)
+	assert.ElementsMatch(t, []string{
+		"jdk-alpine-3.20-java-17",
+		"jdk-alpine-3.20-java-21",
+		"jdk-alpine-3.21-java-17",
+		"jdk-alpine-3.21-java-21",
+	}, plan.Nodes["app"].DependsOn)
+	assert.ElementsMatch(t, []string{"base-alpine-3.20", "base-alpine-3.21"}, plan.Roots)
+
+	layers := plan.Layers()
+	require.Len(t, layers, 3)
+	assert.Len(t, layers[2], 1)
+	assert.Equal(t, "app", layers[2][0].ID)
+
+	// inputs are hashed only when some flag compares them
+	for id, node := range plan.Nodes {
+		assert.Empty(t, node.Hash, id)
+	}
+	flags.SkipUnchanged = true
+	plan, err = parser.GeneratePlan(cfg, flags)
+	require.NoError(t, err)
+	for id, node := range plan.Nodes {
+		assert.NotEmpty(t, node.Hash, id)
+	}
+}
+
+func TestGeneratePlanExplicitDependencyCycle(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{
+		Images: map[string]config.ImageConfig{
+			"a": {Dockerfile: "Dockerfile", Tags: []string{"a"}, DependsOn: []config.Dependency{{Image: "b"}}},
+			"b": {Dockerfile: "Dockerfile", Tags: []string{"b"}, DependsOn: []config.Dependency{{Image: "a"}}},
+		},
+		ImageOrder: []string{"a", "b"},
+	}
+	flags := &config.Flags{BuildFile: "../../tests/test-13.yaml"}
+
+	_, err := parser.GeneratePlan(cfg, flags)
+	assert.ErrorContains(t, err, "cyclic dependency detected")
+
+	cfg.Images["a"] = config.ImageConfig{Dockerfile: "Dockerfile", Tags: []string{"a"}, DependsOn: []config.Dependency{{Image: "missing"}}}
+	_, err = parser.GeneratePlan(cfg, flags)
+	assert.ErrorContains(t, err, "depends on unknown image missing")
+}
+
+func TestGeneratePlanUnknownInternalReference(t *testing.T) {
+	t.Parallel()
+	t.Cleanup(func() {
+		files, _ := filepath.Glob("../../tests/test-case-14b-*.Dockerfile")
+		for _, f := range files {
+			_ = os.Remove(f)
+		}
+	})
+
+	cfg := loadConfig("test-14.yaml")
+
+	// by default it's only a warning
+	plan, err := parser.GeneratePlan(cfg, &config.Flags{BuildFile: "../../tests/test-14.yaml"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"test-case-14-alpine-3.21"}, plan.Nodes["test-case-14b-alpine-3.21"].DependsOn)
+	assert.Empty(t, plan.Nodes["test-case-14b-alpine-3.22"].DependsOn)
+	// base image is known to the build of dependent one
+	bases := plan.Nodes["test-case-14b-alpine-3.21"].Image.Bases()
+	require.Len(t, bases, 1)
+	assert.Same(t, plan.Nodes["test-case-14-alpine-3.21"].Image, bases["repo.local/td/test-case-14:alpine3.21"])
+	assert.Empty(t, plan.Nodes["test-case-14b-alpine-3.22"].Image.Bases())
+
+	// in strict mode planning fails and suggests closest tags
+	_, err = parser.GeneratePlan(cfg, &config.Flags{BuildFile: "../../tests/test-14.yaml", StrictDeps: true})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "image test-case-14b-alpine-3.22 refers to repo.local/td/test-case-14:alpine3.22")
+	assert.Contains(t, err.Error(), "closest: repo.local/td/test-case-14:alpine3.20, repo.local/td/test-case-14:alpine3.21")
+	assert.NotContains(t, err.Error(), "test-case-14b-alpine-3.21")
+
+	// unknown references are reported in a stable order
+	assert.Less(t, strings.Index(err.Error(), "test-case-14:alpine3.22"), strings.Index(err.Error(), "test-case-14:alpine3.23"))
+	for range 5 {
+		_, again := parser.GeneratePlan(cfg, &config.Flags{BuildFile: "../../tests/test-14.yaml", StrictDeps: true})
+		assert.Equal(t, err.Error(), again.Error())
+	}
+}
+
+func TestGeneratePlanSemverTagAliases(t *testing.T) {
+	t.Parallel()
+
+	cfg := loadConfig("test-15.yaml")
+
+	plan, err := parser.GeneratePlan(cfg, &config.Flags{BuildFile: "../../tests/test-15.yaml", Tag: "v1.2.3"})
+	require.NoError(t, err)
+	base := plan.Nodes["base-alpine-3.20"].Image
+	assert.Equal(t, []string{
+		"repo.local/base:v1.2.3",
+		"repo.local/base:v1.2.3-alpine3.20",
+		"repo.local/base:alpine3.20",
+		"repo.local/base:1.2.3",
+		"repo.local/base:1.2.3-alpine3.20",
+		"repo.local/base:1.2",
+		"repo.local/base:1.2-alpine3.20",
+		"repo.local/base:1",
+		"repo.local/base:1-alpine3.20",
+		"repo.local/base:latest",
+		"repo.local/base:latest-alpine3.20",
+	}, base.Tags())
+	assert.Len(t, base.Aliases(), 8)
+	// not enabled for app
+	assert.Equal(t, []string{"repo.local/app:v1.2.3"}, plan.Nodes["app"].Image.Tags())
+
+	var out strings.Builder
+	require.NoError(t, plan.Print(&out))
+	assert.Contains(t, out.String(), "Layer 1:\n  base-alpine-3.20\n")
+	assert.Contains(t, out.String(), "      - repo.local/base:1.2 (alias)\n")
+	assert.Contains(t, out.String(), "Layer 2:\n  app\n")
+	assert.Contains(t, out.String(), "    depends on:\n      - base-alpine-3.20\n")
+
+	// no aliases for pre-releases
+	plan, err = parser.GeneratePlan(cfg, &config.Flags{BuildFile: "../../tests/test-15.yaml", Tag: "v1.2.3-rc.1"})
+	require.NoError(t, err)
+	assert.Empty(t, plan.Nodes["base-alpine-3.20"].Image.Aliases())
+	assert.Len(t, plan.Nodes["base-alpine-3.20"].Image.Tags(), 3)
+}
+
+func TestGeneratePlanNameCollisions(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{
+		Images: map[string]config.ImageConfig{
+			"app": {
+				Dockerfile: "Dockerfile",
+				Variables: map[string]any{
+					// both are sanitized to "a-b"
+					"path": []any{"a/b", "a-b", "c"},
+				},
+				Tags: []string{"app:{{ .path | replace \"/\" \"_\" }}"},
+			},
+		},
+		ImageOrder: []string{"app"},
+	}
+	flags := &config.Flags{BuildFile: "../../tests/test-13.yaml"}
+
+	plan, err := parser.GeneratePlan(cfg, flags)
+	require.NoError(t, err)
+	require.Len(t, plan.Nodes, 3)
+
+	// only colliding combinations get a hash
+	assert.Contains(t, plan.Nodes, "app-path-c")
+	for id := range plan.Nodes {
+		if id != "app-path-c" {
+			assert.Regexp(t, `^app-path-a-b-[0-9a-f]{8}$`, id)
+		}
+	}
+
+	// duplicated combinations can't be resolved
+	cfg.Images["app"] = config.ImageConfig{
+		Dockerfile: "Dockerfile",
+		Variables:  map[string]any{"path": []any{"a", "a"}},
+		Tags:       []string{"app:{{ .path }}"},
+	}
+	_, err = parser.GeneratePlan(cfg, flags)
+	assert.ErrorContains(t, err, "resolves to the same name for combinations")
+}
+
+func TestGeneratePlanTagConflicts(t *testing.T) {
+	t.Parallel()
+
+	cfg := loadConfig("test-16.yaml")
+	flags := &config.Flags{BuildFile: "../../tests/test-16.yaml"}
+
+	plan, err := parser.GeneratePlan(cfg, flags)
+	require.NoError(t, err)
+	require.Len(t, plan.TagConflicts, 3)
+	latest := plan.TagConflicts[1]
+	assert.Equal(t, "repo.local/jdk:latest", latest.Tag)
+	assert.Len(t, latest.Candidates, 4)
+	assert.Equal(t, latest.Candidates[0], latest.Winner)
+	assert.Contains(t, plan.Nodes[latest.Winner].Image.Tags(), "repo.local/jdk:latest")
+
+	var out strings.Builder
+	require.NoError(t, plan.Print(&out))
+	assert.Contains(t, out.String(), "Tag conflicts:\n  repo.local/jdk:17\n    - jdk-alpine-3.20-java-17 (wins)\n")
+
+	// last-wins is the default
+	cfg.TagConflicts = ""
+	plan, err = parser.GeneratePlan(cfg, flags)
+	require.NoError(t, err)
+	latest = plan.TagConflicts[1]
+	assert.Equal(t, latest.Candidates[3], latest.Winner)
+	for _, node := range plan.Nodes {
+		assert.Equal(t, node.ID == latest.Winner, slices.Contains(node.Image.Tags(), "repo.local/jdk:latest"))
+	}
+
+	cfg.TagConflicts = config.TagConflictsError
+	_, err = parser.GeneratePlan(cfg, flags)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "repo.local/jdk:latest produced by jdk-alpine-3.20-java-17, jdk-alpine-3.20-java-21, jdk-alpine-3.21-java-17, jdk-alpine-3.21-java-21")
+}
+
+func TestGeneratePlanSplitPlatforms(t *testing.T) {
+	t.Parallel()
+	t.Cleanup(func() {
+		files, _ := filepath.Glob("../../tests/test-case-17-*.Dockerfile")
+		for _, f := range files {
+			_ = os.Remove(f)
+		}
+	})
+
+	cfg := loadConfig("test-17.yaml")
+	flags := &config.Flags{BuildFile: "../../tests/test-17.yaml", SplitPlatforms: true}
+
+	plan, err := parser.GeneratePlan(cfg, flags)
+	require.NoError(t, err)
+	require.Len(t, plan.Nodes, 4)
+
+	index := plan.Nodes["test-case-17-alpine-3.21"]
+	assert.Equal(t, []string{"test-case-17-alpine-3.21@linux/amd64", "test-case-17-alpine-3.21@linux/arm64"}, index.Parts)
+	assert.Equal(t, index.Parts, index.DependsOn)
+	for _, id := range index.Parts {
+		part := plan.Nodes[id]
+		assert.Len(t, part.Image.Platforms, 1)
+		assert.Equal(t, part.Platform, part.Image.Platforms[0])
+		assert.Same(t, index.Image, part.Image.Parent())
+		assert.Equal(t, index.Hash, part.Hash)
+		assert.Empty(t, part.DependsOn)
+	}
+	assert.ElementsMatch(t, index.Parts, plan.Roots)
+	// dependents wait for the whole index
+	assert.Equal(t, []string{index.ID}, plan.Nodes["test-case-17b"].DependsOn)
+	assert.Empty(t, plan.Nodes["test-case-17b"].Parts)
+
+	var out strings.Builder
+	require.NoError(t, plan.Print(&out))
+	assert.Contains(t, out.String(), "Layer 1:\n  test-case-17-alpine-3.21@linux/amd64\n")
+	assert.Contains(t, out.String(), "    platform: linux/arm64\n")
+	assert.Contains(t, out.String(), "Layer 2:\n  test-case-17-alpine-3.21\n")
+	assert.Contains(t, out.String(), "    depends on:\n      - test-case-17-alpine-3.21@linux/amd64\n      - test-case-17-alpine-3.21@linux/arm64\n")
+
+	// without the flag, platforms are built together
+	flags.SplitPlatforms = false
+	plan, err = parser.GeneratePlan(cfg, flags)
+	require.NoError(t, err)
+	assert.Len(t, plan.Nodes, 2)
+}
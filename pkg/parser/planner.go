@@ -1,22 +1,33 @@
 package parser
 
 import (
+	"errors"
 	"fmt"
+	"maps"
+	"path"
+	"slices"
+	"sort"
+	"strings"
 
 	"github.com/rs/zerolog/log"
 	"github.com/tgagor/template-dockerfiles/pkg/config"
 	"github.com/tgagor/template-dockerfiles/pkg/image"
+	"github.com/tgagor/template-dockerfiles/pkg/util"
 )
 
 type Plan struct {
-	Nodes map[string]*Node
-	Roots []string // Node IDs that have no dependencies and can be built immediately
+	Nodes        map[string]*Node
+	Roots        []string      // Node IDs that have no dependencies and can be built immediately
+	TagConflicts []TagConflict // tags produced by more than one combination
 }
 
 type Node struct {
 	ID        string // Using img.UniqName()
 	Image     *image.Image
 	DependsOn []string // IDs of nodes this node depends on
+	Hash      string   // hash of build inputs, including hashes of dependencies
+	Platform  string   // set for nodes building a single platform of a split image
+	Parts     []string // IDs of per-platform nodes, assembled into an image index by this node
 }
 
 // GeneratePlan builds a Directed Acyclic Graph of images based on config and parsed FROM statements.
@@ -26,7 +37,7 @@ func GeneratePlan(cfg *config.Config, flags *config.Flags) (*Plan, error) {
 		Roots: make([]string, 0),
 	}
 
-	var chronologicalNodes []*Node
+	var images []*image.Image
 
 	// 1. Generate all *image.Image instances
 	for _, name := range cfg.ImageOrder {
@@ -52,77 +63,116 @@ func GeneratePlan(cfg *config.Config, flags *config.Flags) (*Plan, error) {
 			if err := img.Validate(); err != nil {
 				return nil, err
 			}
+			images = append(images, img)
+		}
+	}
 
-			if err := img.Render(); err != nil {
-				return nil, err
-			}
-			log.Debug().Interface("config set", img.Representation()).Msg("Generated")
+	// 1.1 Names have to be unique before anything is rendered to disk
+	if err := disambiguateNames(images); err != nil {
+		return nil, err
+	}
 
-			id := img.UniqName()
-			node := &Node{
-				ID:        id,
-				Image:     img,
-				DependsOn: []string{},
+	// 1.2 Render templates, errors are collected across all combinations,
+	// so all of them can be reported in a single run
+	var chronologicalNodes []*Node
+	var renderErrs []error
+	seenErrs := make(map[string]bool)
+	for _, img := range images {
+		if err := img.Render(); err != nil {
+			// the same broken template fails for every combination, report it once
+			if !seenErrs[err.Error()] {
+				seenErrs[err.Error()] = true
+				renderErrs = append(renderErrs, err)
 			}
-			plan.Nodes[id] = node
-			chronologicalNodes = append(chronologicalNodes, node)
+			continue
 		}
-	}
+		log.Debug().Interface("config set", img.Representation()).Msg("Generated")
 
-	// 1.5 Deduplicate alias tags (Last Write Wins) based on chronological order
-	finalTagOwners := make(map[string]string) // tag -> NodeID
-	// Forward pass to record the *last* owner of each tag
-	for _, node := range chronologicalNodes {
-		for _, tag := range node.Image.Tags() {
-			finalTagOwners[tag] = node.ID
+		id := img.UniqName()
+		node := &Node{
+			ID:        id,
+			Image:     img,
+			DependsOn: []string{},
 		}
+		plan.Nodes[id] = node
+		chronologicalNodes = append(chronologicalNodes, node)
 	}
 
-	// Prune overridden tags
-	for _, node := range chronologicalNodes {
-		var keptOriginalTags []string
-		originalTags := node.Image.OriginalTags()
-		fullyQualifiedTags := node.Image.Tags()
-		for i, tag := range fullyQualifiedTags {
-			if finalTagOwners[tag] == node.ID {
-				keptOriginalTags = append(keptOriginalTags, originalTags[i])
-			} else {
-				log.Debug().Str("tag", tag).Str("image", node.ID).Msg("Tag deduplicated (overwritten by later matrix configuration)")
-			}
-		}
-		node.Image.SetOriginalTags(keptOriginalTags)
+	if len(renderErrs) > 0 {
+		return nil, errors.Join(renderErrs...)
+	}
+
+	// 1.5 Deduplicate tags produced by more than one combination
+	if err := plan.resolveTagConflicts(chronologicalNodes, cfg.TagConflicts); err != nil {
+		return nil, err
 	}
 
 	// 2. Identify dependencies between generated images
-	for _, node := range plan.Nodes {
+	internalPrefix := strings.ToLower(path.Join(cfg.Registry, cfg.Prefix))
+	var unknownRefs []error
+	// sorted by node ID and reference, so warnings and errors are stable between runs
+	for _, id := range slices.Sorted(maps.Keys(plan.Nodes)) {
+		node := plan.Nodes[id]
 		deps, err := node.Image.ExtractFromDependencies()
 		if err != nil {
 			log.Warn().Err(err).Str("image", node.ID).Msg("Failed to extract FROM dependencies. Assuming no inner dependencies.")
 			deps = []string{}
 		}
+		slices.Sort(deps)
 
 		for _, depRef := range deps {
 			// Find which node provides this tag
+			provided := false
 			for providerID, providerNode := range plan.Nodes {
-				if providerID == node.ID {
-					continue
-				}
-
 				// Does providerNode generate the exact tag?
-				provides := false
-				for _, tag := range providerNode.Image.Tags() {
-					if tag == depRef {
-						provides = true
-						break
+				if slices.Contains(providerNode.Image.Tags(), depRef) {
+					if providerID != node.ID {
+						// Note: Since tags can be aliases, we just need one edge per provider image.
+						node.addDependency(providerID)
+						node.Image.AddBase(depRef, providerNode.Image)
 					}
+					provided = true
+					break
 				}
+			}
 
-				if provides {
-					node.DependsOn = append(node.DependsOn, providerID)
-					// Note: Since tags can be aliases, we just need one edge per provider image.
-					break
+			// looks like ours, but nothing builds it - typo or excluded combination?
+			if !provided && internalPrefix != "" && strings.HasPrefix(strings.ToLower(depRef), internalPrefix+"/") {
+				closest := closestTags(plan, depRef, 3)
+				log.Warn().Str("image", node.ID).Str("from", depRef).Strs("closest", closest).Msg("Reference matches registry/prefix, but no planned image produces it")
+				unknownRefs = append(unknownRefs, fmt.Errorf("image %s refers to %s, which is not produced by any planned image (closest: %s)", node.ID, depRef, strings.Join(closest, ", ")))
+			}
+		}
+	}
+	if len(unknownRefs) > 0 && flags.StrictDeps {
+		if flags.Image != "" {
+			log.Warn().Str("image", flags.Image).Msg("Unknown references might be produced by images skipped with --image, not failing")
+		} else {
+			return nil, errors.Join(unknownRefs...)
+		}
+	}
+
+	// 2.5 Merge explicit dependencies from config
+	for _, node := range chronologicalNodes {
+		for _, dep := range node.Image.DependsOn {
+			if _, ok := cfg.Images[dep.Image]; !ok {
+				return nil, fmt.Errorf("image %s depends on unknown image %s", node.Image.Name, dep.Image)
+			}
+			if flags.Image != "" && dep.Image != flags.Image {
+				log.Debug().Str("image", node.ID).Str("depends_on", dep.Image).Msg("Dependency not planned, limited by --image")
+				continue
+			}
+
+			matched := false
+			for _, provider := range chronologicalNodes {
+				if provider.Image.Name == dep.Image && matchesSelector(provider.Image.Variables, dep.Selector) {
+					node.addDependency(provider.ID)
+					matched = true
 				}
 			}
+			if !matched {
+				return nil, fmt.Errorf("image %s depends on %s %v, but no such combination is planned", node.ID, dep.Image, dep.Selector)
+			}
 		}
 	}
 
@@ -131,6 +181,19 @@ func GeneratePlan(cfg *config.Config, flags *config.Flags) (*Plan, error) {
 		return nil, err
 	}
 
+	// 4. Hash inputs of every node, dependencies first, it reads whole build
+	// contexts, so only when some of the flags compares them
+	if flags.Resume || flags.SkipUnchanged {
+		if err := plan.computeHashes(); err != nil {
+			return nil, err
+		}
+	}
+
+	// 5. Build every platform as a separate node, when requested
+	if flags.SplitPlatforms {
+		plan.splitPlatforms()
+	}
+
 	// Find Roots (nodes with DependsOn == 0)
 	for id, node := range plan.Nodes {
 		if len(node.DependsOn) == 0 {
@@ -141,6 +204,137 @@ func GeneratePlan(cfg *config.Config, flags *config.Flags) (*Plan, error) {
 	return plan, nil
 }
 
+// disambiguateNames detects combinations ending up with the same UniqName or
+// generated Dockerfile, because of sanitized variables (like "a/b" and "a-b"),
+// and suffixes their names with a hash of the combination.
+func disambiguateNames(images []*image.Image) error {
+	collisions := func() map[string][]*image.Image {
+		byName := make(map[string][]*image.Image)
+		for _, img := range images {
+			byName["name:"+img.UniqName()] = append(byName["name:"+img.UniqName()], img)
+			if img.Dockerfile != img.DockerfileTemplate {
+				// case insensitive file systems are common
+				key := "file:" + strings.ToLower(img.Dockerfile)
+				byName[key] = append(byName[key], img)
+			}
+		}
+		for key, group := range byName {
+			if len(group) < 2 {
+				delete(byName, key)
+			}
+		}
+		return byName
+	}
+
+	disambiguated := make(map[*image.Image]bool)
+	for _, group := range collisions() {
+		for _, img := range group {
+			if disambiguated[img] {
+				continue
+			}
+			disambiguated[img] = true
+			log.Warn().Str("image", img.Name).Interface("config set", img.Representation()).Msg("Name collides with another combination, adding hash of variables")
+			img.Disambiguate()
+		}
+	}
+
+	// hashes differ for different variables, so it only fails for duplicates
+	var errs []error
+	for _, group := range collisions() {
+		var combinations []string
+		for _, img := range group {
+			combinations = append(combinations, fmt.Sprintf("%v", img.Variables))
+		}
+		errs = append(errs, fmt.Errorf("image %s resolves to the same name for combinations: %s", group[0].UniqName(), strings.Join(combinations, ", ")))
+	}
+	sort.Slice(errs, func(a, b int) bool { return errs[a].Error() < errs[b].Error() })
+	return errors.Join(errs...)
+}
+
+// computeHashes calculates input hashes in topological order, so a change
+// of any image also changes hashes of all images built on top of it.
+func (p *Plan) computeHashes() error {
+	for _, layer := range p.Layers() {
+		for _, node := range layer {
+			var depHashes []string
+			for _, depID := range node.DependsOn {
+				depHashes = append(depHashes, p.Nodes[depID].Hash)
+			}
+			hash, err := node.Image.InputHash(depHashes)
+			if err != nil {
+				return fmt.Errorf("failed to hash inputs of %s: %w", node.ID, err)
+			}
+			node.Hash = hash
+			node.Image.SetInputHash(hash)
+		}
+	}
+	return nil
+}
+
+// splitPlatforms adds a node per platform of multi-platform images. Original
+// node keeps its ID and assembles an image index from them, so dependents
+// still wait for the whole image.
+func (p *Plan) splitPlatforms() {
+	for _, node := range slices.Collect(maps.Values(p.Nodes)) {
+		if !node.Image.SplitPlatforms() {
+			continue
+		}
+		for _, platform := range node.Image.Platforms {
+			part := &Node{
+				ID:        node.ID + "@" + platform,
+				Image:     node.Image.ForPlatform(platform),
+				DependsOn: slices.Clone(node.DependsOn),
+				Hash:      node.Hash, // parts are done, when the whole image is
+				Platform:  platform,
+			}
+			p.Nodes[part.ID] = part
+			node.Parts = append(node.Parts, part.ID)
+		}
+		node.DependsOn = slices.Clone(node.Parts)
+	}
+}
+
+// closestTags returns up to limit planned tags most similar to ref.
+func closestTags(plan *Plan, ref string, limit int) []string {
+	var tags []string
+	for _, node := range plan.Nodes {
+		for _, tag := range node.Image.Tags() {
+			if !slices.Contains(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool {
+		di, dj := util.Levenshtein(ref, tags[i]), util.Levenshtein(ref, tags[j])
+		if di != dj {
+			return di < dj
+		}
+		return tags[i] < tags[j]
+	})
+	if len(tags) > limit {
+		tags = tags[:limit]
+	}
+	return tags
+}
+
+// addDependency adds an edge to the provider, unless it's already there.
+func (n *Node) addDependency(id string) {
+	if !slices.Contains(n.DependsOn, id) {
+		n.DependsOn = append(n.DependsOn, id)
+	}
+}
+
+// matchesSelector checks if all selector values match image variables.
+func matchesSelector(variables map[string]any, selector map[string]string) bool {
+	for key, value := range selector {
+		v, ok := variables[key]
+		if !ok || fmt.Sprintf("%v", v) != value {
+			return false
+		}
+	}
+	return true
+}
+
 // validateNoCycles checks for cyclic dependencies using a depth-first search.
 func (p *Plan) validateNoCycles() error {
 	visited := make(map[string]bool)
@@ -0,0 +1,73 @@
+package parser
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Print writes a human readable summary of the plan: layers that can be
+// built in parallel, tags and dependencies of every image in them, and tags
+// produced by more than one combination. Platforms built separately are
+// listed as nodes of their own.
+func (p *Plan) Print(w io.Writer) error {
+	for n, layer := range p.Layers() {
+		sort.Slice(layer, func(a, b int) bool { return layer[a].ID < layer[b].ID })
+
+		if _, err := fmt.Fprintf(w, "Layer %d:\n", n+1); err != nil {
+			return err
+		}
+		for _, node := range layer {
+			var b strings.Builder
+			fmt.Fprintf(&b, "  %s\n", node.ID)
+			if node.Hash != "" {
+				fmt.Fprintf(&b, "    hash: %s\n", node.Hash)
+			}
+			if node.Platform != "" {
+				// tags belong to the image index assembled from parts
+				fmt.Fprintf(&b, "    platform: %s\n", node.Platform)
+			} else {
+				b.WriteString("    tags:\n")
+				aliases := node.Image.Aliases()
+				for _, tag := range node.Image.Tags() {
+					if slices.Contains(aliases, tag) {
+						fmt.Fprintf(&b, "      - %s (alias)\n", tag)
+					} else {
+						fmt.Fprintf(&b, "      - %s\n", tag)
+					}
+				}
+			}
+			if len(node.DependsOn) > 0 {
+				deps := slices.Sorted(slices.Values(node.DependsOn))
+				b.WriteString("    depends on:\n")
+				for _, dep := range deps {
+					fmt.Fprintf(&b, "      - %s\n", dep)
+				}
+			}
+			if _, err := io.WriteString(w, b.String()); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(p.TagConflicts) > 0 {
+		var b strings.Builder
+		b.WriteString("Tag conflicts:\n")
+		for _, conflict := range p.TagConflicts {
+			fmt.Fprintf(&b, "  %s\n", conflict.Tag)
+			for _, id := range conflict.Candidates {
+				if id == conflict.Winner {
+					fmt.Fprintf(&b, "    - %s (wins)\n", id)
+				} else {
+					fmt.Fprintf(&b, "    - %s\n", id)
+				}
+			}
+		}
+		if _, err := io.WriteString(w, b.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package progress
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/mattn/go-colorable"
+)
+
+// Stdout is where logs and output of commands go. While TTY display is
+// active, everything is printed above the status of running images.
+var Stdout = NewConsole(colorable.NewColorableStdout())
+
+// Console serializes writes, so lines of parallel builds don't mix, and
+// keeps status lines at the bottom of the terminal
+type Console struct {
+	mu     sync.Mutex
+	out    io.Writer
+	status func() []string
+	// number of status lines currently drawn
+	lines int
+}
+
+func NewConsole(out io.Writer) *Console {
+	return &Console{out: out}
+}
+
+func (c *Console) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clear()
+	n, err := c.out.Write(p)
+	c.draw()
+	return n, err
+}
+
+// setStatus starts drawing lines returned by status below the output, nil
+// removes them
+func (c *Console) setStatus(status func() []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clear()
+	c.status = status
+	c.draw()
+}
+
+// redraw refreshes status lines, e.g. to update elapsed time
+func (c *Console) redraw() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clear()
+	c.draw()
+}
+
+func (c *Console) clear() {
+	if c.lines > 0 {
+		// move to the first status line and erase everything below
+		_, _ = fmt.Fprintf(c.out, "\r\x1b[%dA\x1b[J", c.lines)
+		c.lines = 0
+	}
+}
+
+func (c *Console) draw() {
+	if c.status == nil {
+		return
+	}
+	for _, line := range c.status() {
+		_, _ = io.WriteString(c.out, line+"\n")
+		c.lines++
+	}
+}
@@ -0,0 +1,125 @@
+package progress
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+type taskKey struct{}
+
+type taskRef struct {
+	display *Display
+	id      string
+}
+
+// Logger returns logger of the context, with fields of the image and phase,
+// or the global one when there's none
+func Logger(ctx context.Context) *zerolog.Logger {
+	if logger := zerolog.Ctx(ctx); logger.GetLevel() != zerolog.Disabled {
+		return logger
+	}
+	return &log.Logger
+}
+
+// WithPhase adds phase, like build or push, to events logged for the context
+func WithPhase(ctx context.Context, phase string) context.Context {
+	logger := Logger(ctx).With().Str("phase", phase).Logger()
+	return logger.WithContext(ctx)
+}
+
+// Step reports what image of the context is doing. It's logged, unless it's
+// shown in status lines.
+func Step(ctx context.Context, msg string) {
+	t, ok := ctx.Value(taskKey{}).(taskRef)
+	if ok {
+		t.display.Step(t.id, msg)
+	}
+	if !ok || !t.display.TTY() {
+		Logger(ctx).Info().Msg(msg)
+	}
+}
+
+// Skip marks image of the context as skipped
+func Skip(ctx context.Context) {
+	if t, ok := ctx.Value(taskKey{}).(taskRef); ok {
+		t.display.Skip(t.id)
+	}
+}
+
+// Output returns writer for verbose output of commands run for image of the
+// context, or Stdout when there's none
+func Output(ctx context.Context) io.Writer {
+	if t, ok := ctx.Value(taskKey{}).(taskRef); ok {
+		return t.display.Output(ctx, t.id)
+	}
+	return Stdout
+}
+
+// Tee adds log file of image of the context to the writer of command output
+func Tee(ctx context.Context, w io.Writer) io.Writer {
+	if t, ok := ctx.Value(taskKey{}).(taskRef); ok {
+		if log := t.display.logWriter(t.id); log != nil {
+			return io.MultiWriter(w, log)
+		}
+	}
+	return w
+}
+
+// Log writes a line to the log file of image of the context, if there's one
+func Log(ctx context.Context, msg string) {
+	if t, ok := ctx.Value(taskKey{}).(taskRef); ok {
+		t.display.Log(t.id, msg)
+	}
+}
+
+// eventWriter logs every line of command output as an event, for --log-format json
+type eventWriter struct {
+	logger *zerolog.Logger
+}
+
+func (w eventWriter) Write(p []byte) (int, error) {
+	w.logger.Info().Str("stream", "output").Msg(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+// lineWriter writes complete lines only, each one with prefix, so output of
+// parallel builds doesn't mix
+type lineWriter struct {
+	mu     sync.Mutex
+	out    io.Writer
+	prefix func() string
+	buf    []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if _, err := w.out.Write(append([]byte(w.prefix()), w.buf[:i+1]...)); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush writes the last line, even if it's incomplete
+func (w *lineWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) > 0 {
+		_, _ = w.out.Write(append(append([]byte(w.prefix()), w.buf...), '\n'))
+		w.buf = nil
+	}
+}
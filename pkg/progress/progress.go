@@ -0,0 +1,322 @@
+// Package progress shows what images processed in parallel are doing. In a
+// terminal it's a status line per running image with overall counters,
+// otherwise output of every image is prefixed with its name and printed
+// line by line.
+package progress
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/tgagor/template-dockerfiles/pkg/util"
+	"golang.org/x/term"
+)
+
+// Modes of the display, selected with --progress
+const (
+	Auto  = "auto"
+	TTY   = "tty"
+	Plain = "plain"
+)
+
+// refresh is how often elapsed time of running images is updated
+const refresh = 200 * time.Millisecond
+
+// Display tracks images processed by the executor
+type Display struct {
+	console *Console
+	tty     bool
+	width   int
+	height  int
+	total   int
+	logDir  string
+	// command output is logged as events, instead of prefixed lines
+	structured bool
+
+	mu      sync.Mutex
+	tasks   map[string]*task
+	running []string // in order they started
+	done    int
+	skipped int
+	failed  int
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+type task struct {
+	step    string
+	started time.Time
+	skipped bool
+	output  *lineWriter
+	events  []*lineWriter // structured output of every command
+	log     *lineWriter   // nil without --log-dir
+	file    *os.File
+}
+
+// New creates display of total images. In auto mode, status lines are shown
+// only when stdout is a terminal.
+func New(console *Console, mode string, total int) (*Display, error) {
+	d := &Display{
+		console: console,
+		total:   total,
+		tasks:   map[string]*task{},
+		width:   80,
+		height:  24,
+	}
+	switch mode {
+	case "", Auto:
+		d.tty = term.IsTerminal(int(os.Stdout.Fd()))
+	case TTY:
+		d.tty = true
+	case Plain:
+	default:
+		return nil, fmt.Errorf("unsupported --progress '%s', use auto, tty or plain", mode)
+	}
+	if width, height, err := term.GetSize(int(os.Stdout.Fd())); err == nil && width > 0 && height > 0 {
+		d.width, d.height = width, height
+	}
+	return d, nil
+}
+
+// TTY tells if status lines are shown
+func (d *Display) TTY() bool {
+	return d.tty
+}
+
+// Start shows status lines, refreshing them until Stop
+func (d *Display) Start() {
+	if !d.tty {
+		return
+	}
+	d.stop, d.stopped = make(chan struct{}), make(chan struct{})
+	d.console.setStatus(d.status)
+	go func() {
+		defer close(d.stopped)
+		ticker := time.NewTicker(refresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.stop:
+				return
+			case <-ticker.C:
+				d.console.redraw()
+			}
+		}
+	}()
+}
+
+// Stop removes status lines and logs how many images were processed
+func (d *Display) Stop() {
+	if d.stop != nil {
+		close(d.stop)
+		<-d.stopped
+		d.stop = nil
+		d.console.setStatus(nil)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	log.Info().Int("done", d.done).Int("skipped", d.skipped).Int("failed", d.failed).Int("total", d.total).Msg("Processed images")
+}
+
+// SetLogDir makes every image write output of its commands to a log file in dir
+func (d *Display) SetLogDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("can't create log directory %s: %w", dir, err)
+	}
+	d.logDir = dir
+	return nil
+}
+
+// SetStructured logs output of commands as events, for --log-format json
+func (d *Display) SetStructured() {
+	d.structured = true
+}
+
+// LogPath is a log file of the image, or empty without log directory
+func (d *Display) LogPath(id string) string {
+	if d.logDir == "" {
+		return ""
+	}
+	return filepath.Join(d.logDir, util.SanitizeForFileName(id)+".log")
+}
+
+// Begin marks image as running, creating its log file. Commands run with the
+// returned context report their steps and output to the display.
+func (d *Display) Begin(ctx context.Context, id string) (context.Context, error) {
+	t := &task{started: time.Now(), output: &lineWriter{out: d.console, prefix: func() string { return "[" + id + "] " }}}
+	if path := d.LogPath(id); path != "" {
+		file, err := os.Create(path)
+		if err != nil {
+			return ctx, fmt.Errorf("can't create log file of %s: %w", id, err)
+		}
+		t.file = file
+		t.log = &lineWriter{out: file, prefix: timestamp}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.tasks[id] = t
+	d.running = append(d.running, id)
+	return context.WithValue(ctx, taskKey{}, taskRef{display: d, id: id}), nil
+}
+
+// Step shows what image is doing now in its status line and log file
+func (d *Display) Step(id string, msg string) {
+	d.Log(id, msg)
+	if !d.tty {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if t, ok := d.tasks[id]; ok {
+		t.step = msg
+	}
+}
+
+// Log writes a line to the log file of image, if there's one
+func (d *Display) Log(id string, msg string) {
+	if w := d.logWriter(id); w != nil {
+		_, _ = io.WriteString(w, msg+"\n")
+	}
+}
+
+func (d *Display) logWriter(id string) *lineWriter {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if t, ok := d.tasks[id]; ok {
+		return t.log
+	}
+	return nil
+}
+
+// Skip marks running image as skipped, it's counted when it ends
+func (d *Display) Skip(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if t, ok := d.tasks[id]; ok {
+		t.skipped = true
+	}
+}
+
+// End marks image of the context as done, skipped or failed, depending on err
+func (d *Display) End(ctx context.Context, err error) {
+	ref, ok := ctx.Value(taskKey{}).(taskRef)
+	if !ok {
+		return
+	}
+	id := ref.id
+	d.mu.Lock()
+	t, ok := d.tasks[id]
+	if !ok {
+		d.mu.Unlock()
+		return
+	}
+	delete(d.tasks, id)
+	for i, running := range d.running {
+		if running == id {
+			d.running = append(d.running[:i], d.running[i+1:]...)
+			break
+		}
+	}
+	switch {
+	case err != nil:
+		d.failed++
+	case t.skipped:
+		d.skipped++
+	default:
+		d.done++
+	}
+	d.mu.Unlock()
+
+	t.output.Flush()
+	for _, events := range t.events {
+		events.Flush()
+	}
+	if t.log != nil {
+		t.log.Flush()
+		switch {
+		case err != nil:
+			_, _ = io.WriteString(t.log, "Failed after "+elapsed(t.started)+": "+err.Error()+"\n")
+		case t.skipped:
+			_, _ = io.WriteString(t.log, "Skipped\n")
+		default:
+			_, _ = io.WriteString(t.log, "Finished in "+elapsed(t.started)+"\n")
+		}
+		if closeErr := t.file.Close(); closeErr != nil {
+			log.Warn().Err(closeErr).Str("image", id).Msg("Failed to write log file")
+		}
+	}
+	if err == nil && !t.skipped {
+		Logger(ctx).Info().Dur("duration", time.Since(t.started)).Msg("Finished")
+	}
+}
+
+// Output returns writer printing output of image commands line by line,
+// prefixed with image name. In structured mode lines are logged as events,
+// with fields of the context logger, like phase.
+func (d *Display) Output(ctx context.Context, id string) io.Writer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t, ok := d.tasks[id]
+	switch {
+	case !ok:
+		return d.console
+	case d.structured:
+		events := &lineWriter{out: eventWriter{logger: Logger(ctx)}, prefix: func() string { return "" }}
+		t.events = append(t.events, events)
+		return events
+	}
+	return t.output
+}
+
+// status renders counters and a line per running image, fitting the terminal
+func (d *Display) status() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	finished := d.done + d.skipped + d.failed
+	waiting := d.total - finished - len(d.running)
+	lines := []string{d.fit(fmt.Sprintf("[%d/%d] running %d, waiting %d, done %d, skipped %d, failed %d",
+		finished, d.total, len(d.running), waiting, d.done, d.skipped, d.failed))}
+
+	// keep some room for the output above
+	limit := max(d.height/2, 3)
+	for i, id := range d.running {
+		if i == limit-1 && len(d.running) > limit {
+			lines = append(lines, fmt.Sprintf(" => ... and %d more", len(d.running)-i))
+			break
+		}
+		t := d.tasks[id]
+		step := t.step
+		if step == "" {
+			step = "starting"
+		}
+		lines = append(lines, d.fit(fmt.Sprintf(" => %s %s: %s", elapsed(t.started), id, step)))
+	}
+	return lines
+}
+
+// fit truncates line to the terminal width, as wrapped lines can't be cleared
+func (d *Display) fit(line string) string {
+	runes := []rune(line)
+	if len(runes) < d.width || d.width < 8 {
+		return line
+	}
+	return string(runes[:d.width-4]) + "..."
+}
+
+// timestamp prefixes lines of log files
+func timestamp() string {
+	return time.Now().Format("2006-01-02T15:04:05.000Z07:00") + " "
+}
+
+func elapsed(since time.Time) string {
+	return fmt.Sprintf("%.1fs", time.Since(since).Seconds())
+}
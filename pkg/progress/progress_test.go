@@ -0,0 +1,171 @@
+package progress_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgagor/template-dockerfiles/pkg/progress"
+)
+
+// buffer is a console output safe for concurrent use
+type buffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *buffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *buffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// lastStatus returns status lines drawn most recently, after the last clear
+func lastStatus(out string) []string {
+	out = out[strings.LastIndex(out, "\x1b[J")+len("\x1b[J"):]
+	out = strings.TrimPrefix(out, "log line\n")
+	return strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+}
+
+func TestPlainOutputIsPrefixedByLine(t *testing.T) {
+	t.Parallel()
+
+	out := &buffer{}
+	display, err := progress.New(progress.NewConsole(out), progress.Plain, 2)
+	require.NoError(t, err)
+	assert.False(t, display.TTY())
+	display.Start()
+
+	alpineCtx, err := display.Begin(context.Background(), "app-alpine")
+	require.NoError(t, err)
+	debianCtx, err := display.Begin(context.Background(), "app-debian")
+	require.NoError(t, err)
+	alpine := progress.Output(alpineCtx)
+	debian := progress.Output(debianCtx)
+
+	// partial lines wait for the rest
+	_, _ = io.WriteString(alpine, "Step 1/2 : FROM ")
+	_, _ = io.WriteString(debian, "Step 1/2 : FROM debian\nStep 2/2 : RUN")
+	_, _ = io.WriteString(alpine, "alpine\n")
+	display.End(debianCtx, nil)
+	display.End(alpineCtx, errors.New("build failed"))
+
+	// incomplete line is flushed when image ends
+	assert.Equal(t, "[app-debian] Step 1/2 : FROM debian\n"+
+		"[app-alpine] Step 1/2 : FROM alpine\n"+
+		"[app-debian] Step 2/2 : RUN\n", out.String())
+	assert.Equal(t, progress.Stdout, progress.Output(context.Background()))
+}
+
+func TestTTYStatus(t *testing.T) {
+	t.Parallel()
+
+	out := &buffer{}
+	console := progress.NewConsole(out)
+	display, err := progress.New(console, progress.TTY, 4)
+	require.NoError(t, err)
+	assert.True(t, display.TTY())
+	display.Start()
+	defer display.Stop()
+
+	ctx, err := display.Begin(context.Background(), "base")
+	require.NoError(t, err)
+	progress.Step(ctx, "Building base")
+	cached, err := display.Begin(context.Background(), "cached")
+	require.NoError(t, err)
+	progress.Skip(cached)
+	display.End(cached, nil)
+	_, err = display.Begin(context.Background(), "app")
+	require.NoError(t, err)
+
+	_, _ = io.WriteString(console, "log line\n")
+	tail := lastStatus(out.String())
+	require.Len(t, tail, 3)
+	assert.Equal(t, "[1/4] running 2, waiting 1, done 0, skipped 1, failed 0", tail[0])
+	assert.Regexp(t, `^ => \d+\.\ds base: Building base$`, tail[1])
+	assert.Regexp(t, `^ => \d+\.\ds app: starting$`, tail[2])
+
+	// status is cleared before every write and drawn again below it
+	_, _ = io.WriteString(console, "next line\n")
+	assert.Contains(t, out.String(), "\r\x1b[3A\x1b[Jnext line\n[1/4]")
+}
+
+func TestTTYStatusFitsTerminal(t *testing.T) {
+	t.Parallel()
+
+	out := &buffer{}
+	console := progress.NewConsole(out)
+	display, err := progress.New(console, progress.TTY, 30)
+	require.NoError(t, err)
+	display.Start()
+	defer display.Stop()
+
+	for i := range 30 {
+		_, err := display.Begin(context.Background(), fmt.Sprintf("image-%02d", i))
+		require.NoError(t, err)
+	}
+	display.Step("image-00", strings.Repeat("very long step ", 20))
+	_, _ = io.WriteString(console, "log line\n")
+
+	status := lastStatus(out.String())
+	// without terminal, it's 80x24: counters and half of the height for images
+	require.Len(t, status, 13)
+	for _, line := range status {
+		assert.LessOrEqual(t, len([]rune(line)), 80, line)
+	}
+	assert.True(t, strings.HasSuffix(status[1], "..."), status[1])
+	assert.Equal(t, " => ... and 19 more", status[12])
+}
+
+func TestUnsupportedMode(t *testing.T) {
+	t.Parallel()
+
+	_, err := progress.New(progress.Stdout, "fancy", 1)
+	assert.ErrorContains(t, err, "unsupported --progress 'fancy'")
+}
+
+func TestStructuredOutput(t *testing.T) {
+	t.Parallel()
+
+	var events buffer
+	logger := zerolog.New(&events).With().Str("image", "app-alpine").Logger()
+	out := &buffer{}
+	display, err := progress.New(progress.NewConsole(out), progress.Plain, 1)
+	require.NoError(t, err)
+	display.SetStructured()
+
+	ctx, err := display.Begin(logger.WithContext(context.Background()), "app-alpine")
+	require.NoError(t, err)
+	ctx = progress.WithPhase(ctx, "build")
+	progress.Step(ctx, "Building app-alpine")
+	_, _ = io.WriteString(progress.Output(ctx), "#1 DONE 0.1s\n")
+	display.End(ctx, nil)
+
+	assert.Empty(t, out.String(), "nothing is printed besides events")
+	lines := strings.Split(strings.TrimSuffix(events.String(), "\n"), "\n")
+	require.Len(t, lines, 3)
+	var step, output, finished map[string]any
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &step))
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &output))
+	require.NoError(t, json.Unmarshal([]byte(lines[2]), &finished))
+
+	assert.Equal(t, map[string]any{"level": "info", "image": "app-alpine", "phase": "build", "message": "Building app-alpine"}, step)
+	assert.Equal(t, map[string]any{"level": "info", "image": "app-alpine", "phase": "build", "stream": "output", "message": "#1 DONE 0.1s"}, output)
+	assert.Equal(t, "Finished", finished["message"])
+	assert.Contains(t, finished, "duration")
+}
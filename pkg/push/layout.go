@@ -0,0 +1,243 @@
+package push
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// FromLayout reads image or index from OCI layout. BuildKit adds an entry of
+// the same image per tag and appends new builds at the end, so the last
+// entry is the most recent one.
+func FromLayout(dir string) (remote.Taggable, error) {
+	path, err := layout.FromPath(dir)
+	if err != nil {
+		return nil, fmt.Errorf("can't read OCI layout %s: %w", dir, err)
+	}
+	index, err := path.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	if len(manifest.Manifests) == 0 {
+		return nil, fmt.Errorf("no images in OCI layout %s", dir)
+	}
+	desc := manifest.Manifests[len(manifest.Manifests)-1]
+	if desc.MediaType.IsIndex() {
+		return index.ImageIndex(desc.Digest)
+	}
+	return index.Image(desc.Digest)
+}
+
+// FromArchive reads image saved with 'docker save'. Archives of containerd
+// image store are OCI layouts keeping all platforms of the image, an index
+// is read from them after extracting into dir. Otherwise archive is read as
+// docker-archive of a single image, without extracting.
+func FromArchive(archive, dir string) (remote.Taggable, error) {
+	oci, err := isLayout(archive)
+	if err != nil {
+		return nil, fmt.Errorf("can't read %s: %w", archive, err)
+	}
+	if oci {
+		if err := extract(archive, dir); err != nil {
+			return nil, fmt.Errorf("can't extract %s: %w", archive, err)
+		}
+		artifact, err := FromLayout(dir)
+		if err != nil {
+			return nil, err
+		}
+		if index, ok := artifact.(v1.ImageIndex); ok {
+			return index, nil
+		}
+	}
+	img, err := tarball.ImageFromPath(archive, nil)
+	if err != nil {
+		return nil, fmt.Errorf("can't read image from %s: %w", archive, err)
+	}
+	return img, nil
+}
+
+// isLayout checks headers of tar archive for index.json of OCI layout
+func isLayout(archive string) (bool, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = f.Close() }()
+
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if path.Clean(header.Name) == "index.json" {
+			return true, nil
+		}
+	}
+}
+
+// extract unpacks regular files and directories of tar archive into dir
+func extract(archive, dir string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	root := filepath.Clean(dir) + string(os.PathSeparator)
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, header.Name)
+		if !strings.HasPrefix(path, root) {
+			return fmt.Errorf("invalid path %s", header.Name)
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0o755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+				return err
+			}
+			out, err := os.Create(path)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(out, tr)
+			if closeErr := out.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// PlatformImage reads image built for a single platform from OCI layout.
+// BuildKit wraps it in an index when attestations are attached, then the
+// image matching platform is picked.
+func PlatformImage(dir string, platform v1.Platform) (v1.Image, error) {
+	artifact, err := FromLayout(dir)
+	if err != nil {
+		return nil, err
+	}
+	switch artifact := artifact.(type) {
+	case v1.Image:
+		return artifact, nil
+	case v1.ImageIndex:
+		manifest, err := artifact.IndexManifest()
+		if err != nil {
+			return nil, err
+		}
+		for _, desc := range manifest.Manifests {
+			if desc.MediaType.IsImage() && desc.Platform != nil && desc.Platform.Satisfies(platform) {
+				return artifact.Image(desc.Digest)
+			}
+		}
+	}
+	return nil, fmt.Errorf("no image for %s in OCI layout %s", platform.String(), dir)
+}
+
+// Index assembles an image index from images built for single platforms
+func Index(images map[string]v1.Image, platforms []string) (v1.ImageIndex, error) {
+	var addenda []mutate.IndexAddendum
+	for _, p := range platforms {
+		platform, err := v1.ParsePlatform(p)
+		if err != nil {
+			return nil, err
+		}
+		addenda = append(addenda, mutate.IndexAddendum{
+			Add:        images[p],
+			Descriptor: v1.Descriptor{Platform: platform},
+		})
+	}
+	return mutate.AppendManifests(mutate.IndexMediaType(empty.Index, types.OCIImageIndex), addenda...), nil
+}
+
+// WriteLayout saves image or index as OCI layout with an entry annotated
+// with every tag, the way BuildKit does. Existing layout in dir is replaced
+// only when the new one is complete, so artifact can be read from dir itself.
+func WriteLayout(dir string, artifact remote.Taggable, tags []string) error {
+	if err := os.MkdirAll(filepath.Dir(dir), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), filepath.Base(dir)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.RemoveAll(tmp) }()
+
+	path, err := layout.Write(tmp, empty.Index)
+	if err != nil {
+		return err
+	}
+	for _, t := range tags {
+		tag, err := name.NewTag(t)
+		if err != nil {
+			return err
+		}
+		annotations := layout.WithAnnotations(map[string]string{
+			"io.containerd.image.name":          tag.Name(),
+			"org.opencontainers.image.ref.name": tag.TagStr(),
+		})
+		switch artifact := artifact.(type) {
+		case v1.ImageIndex:
+			err = path.AppendIndex(artifact, annotations)
+		case v1.Image:
+			err = path.AppendImage(artifact, annotations)
+		default:
+			err = fmt.Errorf("can't save %T as OCI layout", artifact)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dir)
+}
+
+// WriteArchive saves image as docker-archive, like 'docker save', tagged with all tags
+func WriteArchive(path string, img v1.Image, tags []string) error {
+	refs := make(map[name.Reference]v1.Image, len(tags))
+	for _, t := range tags {
+		tag, err := name.NewTag(t)
+		if err != nil {
+			return err
+		}
+		refs[tag] = img
+	}
+	return tarball.MultiRefWriteToFile(path, refs)
+}
@@ -0,0 +1,145 @@
+// Package push uploads images to registries without Docker daemon. Image is
+// pushed once per repository, remaining tags only point to its manifest.
+package push
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/rs/zerolog/log"
+	"github.com/tgagor/template-dockerfiles/pkg/progress"
+)
+
+// DefaultBackoff is a delay before the first retry
+const DefaultBackoff = time.Second
+
+type Pusher struct {
+	Retries int           // additional attempts after failed request
+	Backoff time.Duration // delay before first retry, doubled with every attempt
+	options []remote.Option
+}
+
+// New creates pusher using credentials from Docker config. Options are passed
+// to go-containerregistry, e.g. to use a custom transport.
+func New(retries int, options ...remote.Option) *Pusher {
+	return &Pusher{
+		Retries: retries,
+		Backoff: DefaultBackoff,
+		options: append([]remote.Option{
+			remote.WithAuthFromKeychain(authn.DefaultKeychain),
+			// retries are handled by Pusher, to not multiply attempts
+			remote.WithRetryBackoff(remote.Backoff{Steps: 1}),
+		}, options...),
+	}
+}
+
+// Push uploads image or index once to every repository found in tags, other
+// tags of the same repository are created with manifest PUTs only
+func (p *Pusher) Push(ctx context.Context, artifact remote.Taggable, tags []string) error {
+	repositories, err := ByRepository(tags)
+	if err != nil {
+		return err
+	}
+	for _, repoTags := range repositories {
+		first, err := name.NewTag(repoTags[0])
+		if err != nil {
+			return err
+		}
+		progress.Step(ctx, "Pushing "+first.String())
+		if err := p.retry(ctx, first.String(), func() error {
+			return remote.Push(first, artifact, p.remoteOptions(ctx)...)
+		}); err != nil {
+			return fmt.Errorf("pushing %s failed: %w", first, err)
+		}
+		if err := p.tag(ctx, artifact, repoTags[1:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PushLayout pushes image from OCI layout, like the one written by buildkit
+// engine or --output oci:<dir>
+func (p *Pusher) PushLayout(ctx context.Context, dir string, tags []string) error {
+	artifact, err := FromLayout(dir)
+	if err != nil {
+		return err
+	}
+	return p.Push(ctx, artifact, tags)
+}
+
+// ByRepository groups tags by repository, keeping their order
+func ByRepository(tags []string) ([][]string, error) {
+	var groups [][]string
+	positions := map[string]int{}
+	for _, t := range tags {
+		tag, err := name.NewTag(t)
+		if err != nil {
+			return nil, err
+		}
+		repository := tag.Context().String()
+		if i, ok := positions[repository]; ok {
+			groups[i] = append(groups[i], t)
+			continue
+		}
+		positions[repository] = len(groups)
+		groups = append(groups, []string{t})
+	}
+	return groups, nil
+}
+
+func (p *Pusher) tag(ctx context.Context, artifact remote.Taggable, tags []string) error {
+	for _, t := range tags {
+		tag, err := name.NewTag(t)
+		if err != nil {
+			return err
+		}
+		progress.Step(ctx, "Tagging "+tag.String())
+		if err := p.retry(ctx, tag.String(), func() error {
+			return remote.Tag(tag, artifact, p.remoteOptions(ctx)...)
+		}); err != nil {
+			return fmt.Errorf("tagging %s failed: %w", tag, err)
+		}
+	}
+	return nil
+}
+
+func (p *Pusher) remoteOptions(ctx context.Context) []remote.Option {
+	return append([]remote.Option{remote.WithContext(ctx)}, p.options...)
+}
+
+// retry calls fn until it succeeds, fails permanently, or runs out of retries
+func (p *Pusher) retry(ctx context.Context, ref string, fn func() error) error {
+	backoff := p.Backoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt > p.Retries || !retryable(err) {
+			return err
+		}
+		log.Warn().Err(err).Str("ref", ref).Int("attempt", attempt).Dur("backoff", backoff).Msg("Registry request failed, retrying")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// retryable tells if error is temporary, like 5xx response or network failure
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var transportErr *transport.Error
+	if errors.As(err, &transportErr) {
+		return transportErr.Temporary()
+	}
+	return true
+}
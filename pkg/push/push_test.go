@@ -0,0 +1,320 @@
+package push_test
+
+import (
+	"archive/tar"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgagor/template-dockerfiles/pkg/push"
+)
+
+// testRegistry is an in-process registry counting requests by method and kind, like "PUT manifests"
+type testRegistry struct {
+	host string
+
+	mu       sync.Mutex
+	requests map[string]int
+	// failures of manifest PUTs to simulate before accepting them
+	failures   int
+	failStatus int
+}
+
+func newTestRegistry(t *testing.T) *testRegistry {
+	t.Helper()
+	r := &testRegistry{requests: map[string]int{}}
+	handler := registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		kind := "other"
+		switch {
+		case strings.Contains(req.URL.Path, "/manifests/"):
+			kind = "manifests"
+		case strings.Contains(req.URL.Path, "/blobs/uploads/"):
+			kind = "uploads"
+		}
+
+		r.mu.Lock()
+		r.requests[req.Method+" "+kind]++
+		fail := kind == "manifests" && req.Method == http.MethodPut && r.failures > 0
+		if fail {
+			r.failures--
+		}
+		r.mu.Unlock()
+
+		if fail {
+			w.WriteHeader(r.failStatus)
+			return
+		}
+		handler.ServeHTTP(w, req)
+	}))
+	t.Cleanup(server.Close)
+	r.host = strings.TrimPrefix(server.URL, "http://")
+	return r
+}
+
+func (r *testRegistry) count(request string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.requests[request]
+}
+
+func (r *testRegistry) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = map[string]int{}
+}
+
+func (r *testRegistry) digest(t *testing.T, tag string) v1.Hash {
+	t.Helper()
+	ref, err := name.ParseReference(tag)
+	require.NoError(t, err)
+	desc, err := remote.Head(ref)
+	require.NoError(t, err)
+	return desc.Digest
+}
+
+func newPusher(retries int) *push.Pusher {
+	p := push.New(retries)
+	p.Backoff = time.Millisecond
+	return p
+}
+
+func TestPushOncePerRepository(t *testing.T) {
+	t.Parallel()
+
+	reg := newTestRegistry(t)
+	img, err := random.Image(1024, 2)
+	require.NoError(t, err)
+	digest, err := img.Digest()
+	require.NoError(t, err)
+
+	tags := []string{
+		reg.host + "/app:1.2.3",
+		reg.host + "/app:1.2",
+		reg.host + "/mirror:1.2.3",
+		reg.host + "/app:latest",
+	}
+	require.NoError(t, newPusher(0).Push(t.Context(), img, tags))
+
+	for _, tag := range tags {
+		assert.Equal(t, digest, reg.digest(t, tag), tag)
+	}
+	// 2 layers and config, uploaded once (test registry shares blobs between repositories)
+	assert.Equal(t, 3, reg.count("POST uploads"))
+	assert.Equal(t, len(tags), reg.count("PUT manifests"))
+}
+
+func TestPushLayout(t *testing.T) {
+	t.Parallel()
+
+	reg := newTestRegistry(t)
+	index, err := random.Index(1024, 1, 2)
+	require.NoError(t, err)
+	digest, err := index.Digest()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	path, err := layout.Write(dir, empty.Index)
+	require.NoError(t, err)
+	// BuildKit adds an entry per tag
+	for _, tag := range []string{"1.0", "latest"} {
+		require.NoError(t, path.AppendIndex(index, layout.WithAnnotations(map[string]string{"org.opencontainers.image.ref.name": tag})))
+	}
+
+	tags := []string{reg.host + "/app:1.0", reg.host + "/app:latest"}
+	require.NoError(t, newPusher(0).PushLayout(t.Context(), dir, tags))
+	for _, tag := range tags {
+		assert.Equal(t, digest, reg.digest(t, tag), tag)
+	}
+
+	_, err = push.FromLayout(t.TempDir())
+	assert.ErrorContains(t, err, "can't read OCI layout")
+}
+
+func TestPushRetries(t *testing.T) {
+	t.Parallel()
+
+	img, err := random.Image(1024, 1)
+	require.NoError(t, err)
+
+	t.Run("temporary failures are retried", func(t *testing.T) {
+		reg := newTestRegistry(t)
+		reg.failures, reg.failStatus = 2, http.StatusServiceUnavailable
+		require.NoError(t, newPusher(2).Push(t.Context(), img, []string{reg.host + "/app:1.0"}))
+		assert.Equal(t, 3, reg.count("PUT manifests"))
+	})
+
+	t.Run("gives up after retries", func(t *testing.T) {
+		reg := newTestRegistry(t)
+		reg.failures, reg.failStatus = 2, http.StatusServiceUnavailable
+		err := newPusher(1).Push(t.Context(), img, []string{reg.host + "/app:1.0"})
+		assert.ErrorContains(t, err, "pushing "+reg.host+"/app:1.0 failed")
+		assert.Equal(t, 2, reg.count("PUT manifests"))
+	})
+
+	t.Run("permanent failures are not retried", func(t *testing.T) {
+		reg := newTestRegistry(t)
+		reg.failures, reg.failStatus = 1, http.StatusForbidden
+		assert.Error(t, newPusher(3).Push(t.Context(), img, []string{reg.host + "/app:1.0"}))
+		assert.Equal(t, 1, reg.count("PUT manifests"))
+	})
+}
+
+func TestByRepository(t *testing.T) {
+	t.Parallel()
+
+	groups, err := push.ByRepository([]string{"app:1", "registry.example.com/app:1", "app:latest"})
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"app:1", "app:latest"}, {"registry.example.com/app:1"}}, groups)
+
+	_, err = push.ByRepository([]string{"app@sha256:abc"})
+	assert.Error(t, err)
+}
+
+func TestPlatformImage(t *testing.T) {
+	t.Parallel()
+
+	img, err := random.Image(512, 1)
+	require.NoError(t, err)
+	attestation, err := random.Image(128, 1)
+	require.NoError(t, err)
+	amd64 := v1.Platform{OS: "linux", Architecture: "amd64"}
+
+	// BuildKit wraps image with attestations in an index
+	index := mutate.AppendManifests(empty.Index,
+		mutate.IndexAddendum{Add: img, Descriptor: v1.Descriptor{Platform: &amd64}},
+		mutate.IndexAddendum{Add: attestation, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "unknown", Architecture: "unknown"}}},
+	)
+	dir := t.TempDir()
+	path, err := layout.Write(dir, empty.Index)
+	require.NoError(t, err)
+	require.NoError(t, path.AppendIndex(index))
+
+	found, err := push.PlatformImage(dir, amd64)
+	require.NoError(t, err)
+	expected, err := img.Digest()
+	require.NoError(t, err)
+	digest, err := found.Digest()
+	require.NoError(t, err)
+	assert.Equal(t, expected, digest)
+
+	_, err = push.PlatformImage(dir, v1.Platform{OS: "linux", Architecture: "arm64"})
+	assert.ErrorContains(t, err, "no image for linux/arm64")
+}
+
+func TestWriteLayout(t *testing.T) {
+	t.Parallel()
+
+	img, err := random.Image(512, 2)
+	require.NoError(t, err)
+	dir := filepath.Join(t.TempDir(), "nested", "app.oci")
+	require.NoError(t, push.WriteLayout(dir, img, []string{"app:1.0", "app:latest"}))
+
+	// rewriting layout with the image read from itself
+	artifact, err := push.FromLayout(dir)
+	require.NoError(t, err)
+	rewritten, err := mutate.Config(artifact.(v1.Image), v1.Config{User: "app"})
+	require.NoError(t, err)
+	require.NoError(t, push.WriteLayout(dir, rewritten, []string{"app:1.0"}))
+
+	artifact, err = push.FromLayout(dir)
+	require.NoError(t, err)
+	expected, err := rewritten.Digest()
+	require.NoError(t, err)
+	digest, err := artifact.(v1.Image).Digest()
+	require.NoError(t, err)
+	assert.Equal(t, expected, digest)
+
+	entries, err := os.ReadDir(filepath.Dir(dir))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "temporary layout is removed")
+}
+
+func TestWriteArchive(t *testing.T) {
+	t.Parallel()
+
+	img, err := random.Image(512, 1)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "app.tar")
+	require.NoError(t, push.WriteArchive(path, img, []string{"app:1.0", "app:latest"}))
+
+	for _, ref := range []string{"app:1.0", "app:latest"} {
+		tag, err := name.NewTag(ref)
+		require.NoError(t, err)
+		_, err = tarball.ImageFromPath(path, &tag)
+		assert.NoError(t, err, ref)
+	}
+}
+
+func TestFromArchive(t *testing.T) {
+	t.Parallel()
+
+	// classic image store saves docker-archive
+	img, err := random.Image(512, 2)
+	require.NoError(t, err)
+	archive := filepath.Join(t.TempDir(), "saved.tar")
+	require.NoError(t, push.WriteArchive(archive, img, []string{"app:1.0"}))
+	dir := t.TempDir()
+	artifact, err := push.FromArchive(archive, dir)
+	require.NoError(t, err)
+	require.Implements(t, (*v1.Image)(nil), artifact)
+	assert.Equal(t, digestOf(t, img), digestOf(t, artifact.(v1.Image)))
+	// and it's read without extracting
+	extracted, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, extracted)
+
+	// containerd image store saves OCI layout, with all platforms
+	index, err := random.Index(512, 1, 2)
+	require.NoError(t, err)
+	dir = filepath.Join(t.TempDir(), "app.oci")
+	require.NoError(t, push.WriteLayout(dir, index, []string{"app:1.0"}))
+	archive = filepath.Join(t.TempDir(), "saved.tar")
+	require.NoError(t, tarDir(dir, archive))
+	artifact, err = push.FromArchive(archive, t.TempDir())
+	require.NoError(t, err)
+	require.Implements(t, (*v1.ImageIndex)(nil), artifact)
+	want, err := index.Digest()
+	require.NoError(t, err)
+	got, err := artifact.(v1.ImageIndex).Digest()
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+}
+
+func digestOf(t *testing.T, img v1.Image) v1.Hash {
+	digest, err := img.Digest()
+	require.NoError(t, err)
+	return digest
+}
+
+// tarDir archives files of dir, like 'docker save' does with OCI layout
+func tarDir(dir, archive string) error {
+	f, err := os.Create(archive)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	tw := tar.NewWriter(f)
+	if err := tw.AddFS(os.DirFS(dir)); err != nil {
+		return err
+	}
+	return tw.Close()
+}
@@ -0,0 +1,141 @@
+// Package squash flattens layers of built images into a single one. It works
+// on images, not containers, so the whole config (user, ports, healthcheck,
+// entrypoint, ...) and history are preserved.
+package squash
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// CreatedBy marks history entry of the squashed layer
+const CreatedBy = "td squash"
+
+// Image flattens all layers into one. Original history entries are kept,
+// marked as empty layers, followed by an entry of the squashed layer.
+func Image(img v1.Image) (v1.Image, error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	if len(layers) < 2 {
+		return img, nil
+	}
+
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	cfg = cfg.DeepCopy()
+	for i := range cfg.History {
+		cfg.History[i].EmptyLayer = true
+	}
+	cfg.RootFS.DiffIDs = nil
+
+	manifestType, err := img.MediaType()
+	if err != nil {
+		return nil, err
+	}
+	layerType := types.DockerLayer
+	if manifestType == types.OCIManifestSchema1 {
+		layerType = types.OCILayer
+	}
+
+	base, err := mutate.ConfigFile(mutate.MediaType(empty.Image, manifestType), cfg)
+	if err != nil {
+		return nil, err
+	}
+	if manifestType == types.OCIManifestSchema1 {
+		base = mutate.ConfigMediaType(base, types.OCIConfigJSON)
+	}
+
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return mutate.Extract(img), nil
+	}, tarball.WithMediaType(layerType))
+	if err != nil {
+		return nil, err
+	}
+	return mutate.Append(base, mutate.Addendum{
+		Layer: layer,
+		History: v1.History{
+			Created:   cfg.Created, // keeps builds reproducible
+			CreatedBy: CreatedBy,
+			Comment:   fmt.Sprintf("squashed %d layers", len(layers)),
+		},
+		MediaType: layerType,
+	})
+}
+
+// Index squashes every image of the index, keeping their platforms.
+// Attestations refer to the original images, so they're dropped.
+func Index(index v1.ImageIndex) (v1.ImageIndex, error) {
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	squashed := mutate.IndexMediaType(empty.Index, manifest.MediaType)
+	for _, desc := range manifest.Manifests {
+		if !desc.MediaType.IsImage() || isAttestation(desc) {
+			continue
+		}
+		img, err := index.Image(desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if img, err = Image(img); err != nil {
+			return nil, err
+		}
+		squashed = mutate.AppendManifests(squashed, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{Platform: desc.Platform, Annotations: desc.Annotations},
+		})
+	}
+	return squashed, nil
+}
+
+// Artifact squashes an image, or all images of an index
+func Artifact(artifact remote.Taggable) (remote.Taggable, error) {
+	switch artifact := artifact.(type) {
+	case v1.ImageIndex:
+		return Index(artifact)
+	case v1.Image:
+		return Image(artifact)
+	}
+	return nil, fmt.Errorf("can't squash %T, only images and indexes are supported", artifact)
+}
+
+// Archive squashes the only image of docker-archive at src, like the one
+// from 'docker save', and writes it to dst tagged with all tags
+func Archive(src, dst string, tags []string) error {
+	img, err := tarball.ImageFromPath(src, nil)
+	if err != nil {
+		return fmt.Errorf("can't read image from %s: %w", src, err)
+	}
+	squashed, err := Image(img)
+	if err != nil {
+		return err
+	}
+	refs := make(map[name.Reference]v1.Image, len(tags))
+	for _, t := range tags {
+		tag, err := name.NewTag(t)
+		if err != nil {
+			return err
+		}
+		refs[tag] = squashed
+	}
+	return tarball.MultiRefWriteToFile(dst, refs)
+}
+
+// isAttestation tells if descriptor points to BuildKit attestation manifest
+func isAttestation(desc v1.Descriptor) bool {
+	return desc.Annotations["vnd.docker.reference.type"] == "attestation-manifest"
+}
@@ -0,0 +1,260 @@
+package squash_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgagor/template-dockerfiles/pkg/squash"
+)
+
+type entry struct {
+	name    string
+	content string
+	dir     bool
+}
+
+// layer creates an uncompressed layer with given files, directories and whiteouts
+func layer(t *testing.T, entries ...entry) v1.Layer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Mode: 0o644, Size: int64(len(e.content)), Typeflag: tar.TypeReg}
+		if e.dir {
+			header = &tar.Header{Name: e.name, Mode: 0o755, Typeflag: tar.TypeDir}
+		}
+		require.NoError(t, tw.WriteHeader(header))
+		_, err := tw.Write([]byte(e.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	content := buf.Bytes()
+	l, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(content)), nil
+	})
+	require.NoError(t, err)
+	return l
+}
+
+// files reads flattened file system of the image
+func files(t *testing.T, img v1.Image) map[string]string {
+	t.Helper()
+	result := map[string]string{}
+	layers, err := img.Layers()
+	require.NoError(t, err)
+	require.Len(t, layers, 1)
+	rc, err := layers[0].Uncompressed()
+	require.NoError(t, err)
+	defer rc.Close()
+
+	tr := tar.NewReader(rc)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		content, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		result[header.Name] = string(content)
+	}
+	return result
+}
+
+func testImage(t *testing.T) v1.Image {
+	t.Helper()
+	created := v1.Time{Time: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+
+	img, err := mutate.Append(empty.Image,
+		mutate.Addendum{
+			Layer: layer(t,
+				entry{name: "etc/app.conf", content: "v1"},
+				entry{name: "bin/tool", content: "tool"},
+				entry{name: "data", dir: true},
+				entry{name: "data/a", content: "a"},
+				entry{name: "data/b", content: "b"},
+			),
+			History: v1.History{CreatedBy: "ADD rootfs /", Created: created},
+		},
+		mutate.Addendum{
+			Layer: layer(t,
+				entry{name: "etc/app.conf", content: "v2"},
+				entry{name: "tmp/cache", content: "junk"},
+			),
+			History: v1.History{CreatedBy: "RUN configure", Created: created},
+		},
+		mutate.Addendum{
+			Layer: layer(t,
+				entry{name: "tmp/.wh.cache"},
+				entry{name: "data/.wh..wh..opq"},
+				entry{name: "data/c", content: "c"},
+			),
+			History: v1.History{CreatedBy: "RUN cleanup", Created: created},
+		},
+	)
+	require.NoError(t, err)
+
+	cfg, err := img.ConfigFile()
+	require.NoError(t, err)
+	cfg = cfg.DeepCopy()
+	cfg.Created = created
+	cfg.OS, cfg.Architecture = "linux", "amd64"
+	cfg.Config = v1.Config{
+		User:         "app",
+		ExposedPorts: map[string]struct{}{"8080/tcp": {}},
+		Healthcheck:  &v1.HealthConfig{Test: []string{"CMD", "/bin/tool", "health"}, Interval: 30 * time.Second},
+		StopSignal:   "SIGTERM",
+		OnBuild:      []string{"RUN echo child"},
+		Entrypoint:   []string{"/bin/tool"},
+		Cmd:          []string{"--help"},
+		Env:          []string{"PATH=/bin", "APP_ENV=prod"},
+		Labels:       map[string]string{"org.opencontainers.image.title": "app"},
+		Volumes:      map[string]struct{}{"/data": {}},
+		WorkingDir:   "/data",
+	}
+	img, err = mutate.ConfigFile(img, cfg)
+	require.NoError(t, err)
+	return img
+}
+
+func TestImage(t *testing.T) {
+	t.Parallel()
+
+	img := testImage(t)
+	squashed, err := squash.Image(img)
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]string{
+		"etc/app.conf": "v2",
+		"bin/tool":     "tool",
+		"data":         "",
+		"data/c":       "c",
+	}, files(t, squashed))
+
+	before, err := img.ConfigFile()
+	require.NoError(t, err)
+	after, err := squashed.ConfigFile()
+	require.NoError(t, err)
+	assert.Equal(t, before.Config, after.Config)
+	assert.Equal(t, before.Created, after.Created)
+	assert.Equal(t, "amd64", after.Architecture)
+
+	require.Len(t, after.History, 4)
+	for _, h := range after.History[:3] {
+		assert.True(t, h.EmptyLayer, h.CreatedBy)
+	}
+	assert.Equal(t, "RUN configure", after.History[1].CreatedBy)
+	assert.Equal(t, squash.CreatedBy, after.History[3].CreatedBy)
+	assert.Equal(t, "squashed 3 layers", after.History[3].Comment)
+	assert.False(t, after.History[3].EmptyLayer)
+	assert.Len(t, after.RootFS.DiffIDs, 1)
+
+	// the same input gives the same image
+	again, err := squash.Image(img)
+	require.NoError(t, err)
+	d1, err := squashed.Digest()
+	require.NoError(t, err)
+	d2, err := again.Digest()
+	require.NoError(t, err)
+	assert.Equal(t, d1, d2)
+}
+
+func TestImageSingleLayer(t *testing.T) {
+	t.Parallel()
+
+	img, err := random.Image(256, 1)
+	require.NoError(t, err)
+	squashed, err := squash.Image(img)
+	require.NoError(t, err)
+	assert.Same(t, img, squashed)
+}
+
+func TestImageKeepsMediaTypes(t *testing.T) {
+	t.Parallel()
+
+	img := mutate.ConfigMediaType(mutate.MediaType(testImage(t), types.OCIManifestSchema1), types.OCIConfigJSON)
+	squashed, err := squash.Image(img)
+	require.NoError(t, err)
+
+	manifest, err := squashed.Manifest()
+	require.NoError(t, err)
+	assert.Equal(t, types.OCIManifestSchema1, manifest.MediaType)
+	assert.Equal(t, types.OCIConfigJSON, manifest.Config.MediaType)
+	assert.Equal(t, types.OCILayer, manifest.Layers[0].MediaType)
+}
+
+func TestIndex(t *testing.T) {
+	t.Parallel()
+
+	amd64, err := random.Image(256, 3)
+	require.NoError(t, err)
+	arm64, err := random.Image(256, 2)
+	require.NoError(t, err)
+	attestation, err := random.Image(64, 1)
+	require.NoError(t, err)
+
+	index := mutate.AppendManifests(empty.Index,
+		mutate.IndexAddendum{Add: amd64, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}}},
+		mutate.IndexAddendum{Add: arm64, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "arm64"}}},
+		mutate.IndexAddendum{Add: attestation, Descriptor: v1.Descriptor{
+			Platform:    &v1.Platform{OS: "unknown", Architecture: "unknown"},
+			Annotations: map[string]string{"vnd.docker.reference.type": "attestation-manifest"},
+		}},
+	)
+
+	squashed, err := squash.Artifact(index)
+	require.NoError(t, err)
+	manifest, err := squashed.(v1.ImageIndex).IndexManifest()
+	require.NoError(t, err)
+	require.Len(t, manifest.Manifests, 2)
+	assert.Equal(t, "linux/amd64", manifest.Manifests[0].Platform.String())
+	assert.Equal(t, "linux/arm64", manifest.Manifests[1].Platform.String())
+
+	img, err := squashed.(v1.ImageIndex).Image(manifest.Manifests[0].Digest)
+	require.NoError(t, err)
+	layers, err := img.Layers()
+	require.NoError(t, err)
+	assert.Len(t, layers, 1)
+}
+
+func TestArchive(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "saved.tar")
+	dst := filepath.Join(dir, "squashed.tar")
+	ref, err := name.NewTag("app-alpine-3.21")
+	require.NoError(t, err)
+	require.NoError(t, tarball.WriteToFile(src, ref, testImage(t)))
+
+	require.NoError(t, squash.Archive(src, dst, []string{"app-alpine-3.21", "app:latest"}))
+
+	squashed, err := tarball.ImageFromPath(dst, &ref)
+	require.NoError(t, err)
+	assert.Equal(t, "v2", files(t, squashed)["etc/app.conf"])
+	cfg, err := squashed.ConfigFile()
+	require.NoError(t, err)
+	assert.Equal(t, "app", cfg.Config.User)
+	assert.Equal(t, []string{"RUN echo child"}, cfg.Config.OnBuild)
+
+	latest, err := name.NewTag("app:latest")
+	require.NoError(t, err)
+	_, err = tarball.ImageFromPath(dst, &latest)
+	assert.NoError(t, err)
+
+	assert.ErrorContains(t, squash.Archive(filepath.Join(dir, "missing.tar"), dst, []string{"app"}), "can't read image from")
+}
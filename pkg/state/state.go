@@ -0,0 +1,111 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/tgagor/template-dockerfiles/pkg/util"
+)
+
+type Outcome string
+
+const (
+	Built  Outcome = "built"
+	Pushed Outcome = "pushed"
+	Failed Outcome = "failed"
+)
+
+// Entry records result of processing a single node of the plan.
+type Entry struct {
+	Hash    string    `json:"hash"`
+	Outcome Outcome   `json:"outcome"`
+	Updated time.Time `json:"updated"`
+}
+
+// State keeps track of processed nodes between runs, so a failed run can be resumed.
+// It's saved after every change.
+type State struct {
+	mu    sync.Mutex
+	path  string
+	Nodes map[string]Entry `json:"nodes"` // keyed by UniqName
+}
+
+// Path returns location of the state file for given config file and tag,
+// kept in .td directory next to the config file.
+func Path(buildFile string, tag string) string {
+	name := strings.TrimSuffix(filepath.Base(buildFile), filepath.Ext(buildFile))
+	if tag == "" {
+		tag = "untagged"
+	}
+	return filepath.Join(filepath.Dir(buildFile), ".td", util.SanitizeForFileName(name+"-"+tag)+".state.json")
+}
+
+// Load reads state from path, missing file results in an empty state.
+func Load(path string) (*State, error) {
+	s := &State{path: path, Nodes: map[string]Entry{}}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("corrupted state file %s: %w", path, err)
+	}
+	if s.Nodes == nil {
+		s.Nodes = map[string]Entry{}
+	}
+	log.Debug().Str("file", path).Int("nodes", len(s.Nodes)).Msg("Loaded state")
+	return s, nil
+}
+
+// Record stores outcome of a node and saves the state file.
+func (s *State) Record(id string, hash string, outcome Outcome) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Nodes[id] = Entry{Hash: hash, Outcome: outcome, Updated: time.Now().UTC()}
+	return s.save()
+}
+
+// Done checks if a node with the same inputs was already processed successfully.
+// When push is required, only pushed nodes count as done.
+func (s *State) Done(id string, hash string, push bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.Nodes[id]
+	if !ok || entry.Hash != hash {
+		return false
+	}
+	if push {
+		return entry.Outcome == Pushed
+	}
+	return entry.Outcome == Built || entry.Outcome == Pushed
+}
+
+// save writes state atomically, so an interrupted run never leaves a broken file
+func (s *State) save() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
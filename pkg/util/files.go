@@ -1,7 +1,10 @@
 package util
 
 import (
+	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
 	"regexp"
 
 	"github.com/rs/zerolog/log"
@@ -16,10 +19,85 @@ func RemoveFile(files ...string) {
 	}
 }
 
+func RemoveDir(dirs ...string) {
+	for _, dir := range dirs {
+		log.Debug().Str("dir", dir).Msg("Removing temporary")
+		if err := os.RemoveAll(dir); err != nil {
+			log.Error().Err(err).Str("dir", dir).Msg("Failed to remove")
+		}
+	}
+}
+
+// CopyDir recursively copies content of src directory into dst,
+// preserving file modes and symlinks.
+func CopyDir(src string, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		return CopyEntry(path, filepath.Join(dst, rel), d)
+	})
+}
+
+// CopyEntry copies single entry of a directory walk into target, preserving
+// file mode and symlinks. Parent directories of target are created if needed.
+func CopyEntry(path string, target string, d fs.DirEntry) error {
+	info, err := d.Info()
+	if err != nil {
+		return err
+	}
+	if d.IsDir() {
+		return os.MkdirAll(target, info.Mode().Perm())
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+
+	switch {
+	case d.Type()&fs.ModeSymlink != 0:
+		link, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(link, target)
+	case d.Type().IsRegular():
+		return copyFile(path, target, info.Mode().Perm())
+	default:
+		// skip sockets, devices and other special files
+		log.Debug().Str("file", path).Msg("Skipping special file")
+		return nil
+	}
+}
+
+func copyFile(src string, dst string, mode fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := in.Close(); err != nil {
+			log.Error().Err(err).Str("file", src).Msg("Error closing")
+		}
+	}()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
 func SanitizeForFileName(input string) string {
 	// Replace any character that is not a letter, number, or safe symbol (-, _) with an underscore
-	// FIXME: This can actually result in collisions if someones uses a lot of symbols in variables
-	// 		  But I didn't face it yet, maybe it's not a problem at all
+	// Different inputs can end up the same, callers have to detect such collisions
 	reg := regexp.MustCompile(`[^a-zA-Z0-9-_\.]+`)
 	return reg.ReplaceAllString(input, "_")
 }
@@ -0,0 +1,27 @@
+package util_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tgagor/template-dockerfiles/pkg/util"
+)
+
+func TestLevenshtein(t *testing.T) {
+	// Arrange
+	input := [][2]string{
+		{"", ""},
+		{"alpine", ""},
+		{"", "alpine"},
+		{"alpine", "alpine"},
+		{"repo.local/base:alpine3.22", "repo.local/base:alpine3.21"},
+		{"kitten", "sitting"},
+		{"gągor", "gagor"},
+	}
+	expected := []int{0, 6, 6, 0, 1, 3, 1}
+
+	// Assert
+	for i, input := range input {
+		assert.Equal(t, expected[i], util.Levenshtein(input[0], input[1]))
+	}
+}
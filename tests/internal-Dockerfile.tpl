@@ -0,0 +1,3 @@
+FROM {{ .registry }}/{{ .prefix }}/test-case-14:alpine{{ .alpine }}
+
+RUN echo "built on top of an internal image"
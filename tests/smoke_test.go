@@ -293,3 +293,43 @@ func TestCase9(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, code, 0)
 }
+
+// Broken templates should fail the run with a readable error, not a panic
+func TestCase12(t *testing.T) {
+	t.Parallel()
+
+	cmd := command(
+		"--no-color",
+		"--config", "test-12.yaml",
+	)
+
+	out, err := shell.RunCommandContextAndGetOutputE(t, t.Context(), &cmd)
+	assert.NotNil(t, err) // should fail
+
+	assert.NotContains(t, out, "panic:")
+	assert.Contains(t, out, "Error during parsing/planning")
+	assert.Contains(t, out, "image test-case-12")
+
+	code, err := shell.GetExitCodeForRunCommandError(err)
+	assert.Nil(t, err)
+	assert.NotEqual(t, code, 0)
+}
+
+func TestCase15(t *testing.T) {
+	t.Parallel()
+
+	cmd := command(
+		"plan",
+		"--no-color",
+		"--config", "test-15.yaml",
+		"--tag", "v1.2.3",
+	)
+
+	out, err := shell.RunCommandContextAndGetOutputE(t, t.Context(), &cmd)
+	assert.Nil(t, err)
+
+	assert.NotContains(t, out, "panic:")
+	assert.Contains(t, out, "repo.local/base:1.2-alpine3.20 (alias)")
+	assert.Contains(t, out, "repo.local/base:latest (alias)")
+	assert.Contains(t, out, "depends on:")
+}